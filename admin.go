@@ -13,23 +13,33 @@ import (
 	"github.com/nikolalohinski/gonja/v2/exec"
 )
 
-func (app *App) serveAdmin(w http.ResponseWriter, r *http.Request) {
+// authorizeAdmin checks that the admin interface is enabled and the request has valid credentials.
+// If not, the response has already been written.
+func (app *App) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
 	if !app.Config.EnableAdmin {
 		http.NotFound(w, r)
-		return
+		return false
 	}
 
 	username, password, ok := r.BasicAuth()
 	if !ok {
 		w.Header().Set("WWW-Authenticate", `Basic realm="Admin Access"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
+		return false
 	}
 
 	if username != app.Config.AdminUsername || password != app.Config.AdminPassword {
 		time.Sleep(1 * time.Second) // Prevent brute force attacks
 		w.Header().Set("WWW-Authenticate", `Basic realm="Admin Access"`)
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func (app *App) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
 		return
 	}
 
@@ -47,6 +57,11 @@ func (app *App) serveAdmin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("openapi") == "show" {
+		app.serveOpenAPIViewer(w, r)
+		return
+	}
+
 	sqlParam := r.URL.Query().Get("console")
 	if sqlParam == "show" {
 		app.serveSqlConsole(w, r)
@@ -87,6 +102,8 @@ func (app *App) serveAdminIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	httpStats := app.http.Stats()
+
 	renderTime := time.Since(startTime).Milliseconds()
 
 	tplData := exec.NewContext(map[string]any{
@@ -95,6 +112,15 @@ func (app *App) serveAdminIndex(w http.ResponseWriter, r *http.Request) {
 			"hits":   app.hitsProcessed.Load(),
 			"routes": app.totalRoutes.Load(),
 		},
+		"http": map[string]any{
+			"requests":    httpStats.Requests,
+			"failures":    httpStats.Failures,
+			"blocked":     httpStats.Blocked,
+			"cache":       app.Config.HTTPCache,
+			"cache_hits":  httpStats.CacheHits,
+			"avg_latency": httpStats.AvgLatency.Round(time.Millisecond).String(),
+			"max_latency": httpStats.MaxLatency.Round(time.Millisecond).String(),
+		},
 		"routes_list": routes,
 		"tables_list": tables,
 		"render_ms":   renderTime,
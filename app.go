@@ -3,17 +3,21 @@ package main
 import (
 	"database/sql"
 	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	ut "github.com/go-playground/universal-translator"
 	"github.com/go-playground/validator/v10"
 	"github.com/nikolalohinski/gonja/v2/exec"
 	"github.com/sad-pixel/wtfhttpd/cache"
+	"github.com/sad-pixel/wtfhttpd/udfs"
 )
 
 // App holds application-wide dependencies
@@ -25,11 +29,59 @@ type App struct {
 	totalRoutes   atomic.Int64
 
 	mu       sync.RWMutex
+	reloadMu sync.Mutex
+	indexMu  sync.Mutex
 	kv       *cache.KVCache
+	http     *udfs.HTTPClient
+	jwt      *udfs.JWT
+	flashKey []byte
 	router   http.Handler
+	routes   *routeTable
 	vd       *validator.Validate
-	tpl      map[string]*exec.Template
-	sqlCache map[string]string
+	ut       *ut.UniversalTranslator
+}
+
+// routeTable holds everything loaded from the webroot to serve the routes.
+// Reloads build a new table and swap it in along with the router, and a
+// table is never modified once it has been swapped in.
+type routeTable struct {
+	tpl        map[string]*exec.Template
+	tplDeps    map[string][]string
+	sqlCache   map[string]string
+	middleware map[string]routeMiddleware
+	pages      map[string]map[string]any
+	routePaths map[string]string
+
+	// contentLayouts maps the content files served as routes to their layout templates
+	contentLayouts map[string]string
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		tpl:            make(map[string]*exec.Template),
+		tplDeps:        make(map[string][]string),
+		sqlCache:       make(map[string]string),
+		middleware:     make(map[string]routeMiddleware),
+		pages:          make(map[string]map[string]any),
+		routePaths:     make(map[string]string),
+		contentLayouts: make(map[string]string),
+	}
+}
+
+// withTemplates copies the table with its own template maps, so templates can be
+// added or replaced without touching the table requests are reading
+func (routes *routeTable) withTemplates() *routeTable {
+	next := *routes
+	next.tpl = maps.Clone(routes.tpl)
+	next.tplDeps = maps.Clone(routes.tplDeps)
+	return &next
+}
+
+// currentRoutes returns the route table in use
+func (app *App) currentRoutes() *routeTable {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+	return app.routes
 }
 
 func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -40,11 +92,35 @@ func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	router.ServeHTTP(w, r)
 }
 
+// reloadRoutes loads the routes and brings the content index up to date. Content routes
+// are built from the index, so with content_routes it's updated first, and the routes are
+// loaded once. Otherwise it's updated in the background, so a large content directory
+// doesn't hold up the reload.
 func (app *App) reloadRoutes() error {
+	if !app.Config.ContentRoutes {
+		if err := app.loadRoutes(); err != nil {
+			return err
+		}
+		app.reindexContent()
+		return nil
+	}
+
+	if _, err := app.indexContent(); err != nil {
+		log.Printf("Error indexing content: %v", err)
+	}
+	return app.loadRoutes()
+}
+
+// loadRoutes loads the routes from the webroot and the content index, and swaps them
+// in for the current ones
+func (app *App) loadRoutes() error {
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
 	log.Println("Reloading Routes...")
 
-	app.tpl = make(map[string]*exec.Template)
-	app.sqlCache = make(map[string]string)
+	// Requests keep using the current routes until the new ones are fully loaded
+	routes := newRouteTable()
 
 	// Clear the wtf_routes table before reloading
 	_, err := app.DB.Exec("DELETE FROM wtf_routes")
@@ -57,22 +133,41 @@ func (app *App) reloadRoutes() error {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/_wtf", app.serveAdmin)
+	mux.HandleFunc("/_wtf/openapi.json", app.serveOpenAPI)
 
-	err = setupRoutes(app, mux)
+	err = setupRoutes(app, routes, mux)
 	if err != nil {
 		log.Printf("Error during route reload: %v", err)
 		return err
 	}
 
-	app.mu.Lock()
-	app.router = mux
-	app.mu.Unlock()
+	if err := loadGlobals(app, routes); err != nil {
+		log.Printf("Error loading template globals: %v", err)
+		return err
+	}
 
-	if err := app.indexContent(); err != nil {
-		log.Printf("Error indexing content: %v", err)
+	if app.Config.ContentRoutes {
+		if err := setupContentRoutes(app, routes, mux); err != nil {
+			log.Printf("Error setting up content routes: %v", err)
+			return err
+		}
+	}
+
+	if app.Config.Feeds {
+		setupFeedRoutes(app, mux)
+	}
+
+	routes.routePaths, err = loadRoutePaths(app.DB)
+	if err != nil {
+		log.Printf("Error loading route paths: %v", err)
 		return err
 	}
 
+	app.mu.Lock()
+	app.router = mux
+	app.routes = routes
+	app.mu.Unlock()
+
 	log.Printf("Total routes: %d", app.totalRoutes.Load())
 	return nil
 }
@@ -96,6 +191,10 @@ func (app *App) liveReloader() {
 
 	var debounceTimer *time.Timer
 
+	// Files changed within the debounce window
+	var changedMu sync.Mutex
+	changed := make(map[string]bool)
+
 	go func() {
 		for {
 			select {
@@ -113,6 +212,10 @@ func (app *App) liveReloader() {
 				}
 
 				if event.Has(fsnotify.Create) || event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) || event.Has(fsnotify.Write) {
+					changedMu.Lock()
+					changed[event.Name] = true
+					changedMu.Unlock()
+
 					if debounceTimer != nil {
 						debounceTimer.Reset(200 * time.Millisecond)
 					} else {
@@ -128,6 +231,25 @@ func (app *App) liveReloader() {
 								})
 							}
 
+							changedMu.Lock()
+							var paths []string
+							for path := range changed {
+								paths = append(paths, path)
+							}
+							changed = make(map[string]bool)
+							changedMu.Unlock()
+
+							// Template changes only need the templates depending on them to be re-parsed
+							if app.reloadTemplates(paths) {
+								return
+							}
+
+							// Markdown changes only need the content to be reindexed
+							if app.onlyContentChanged(paths) {
+								app.reindexContent()
+								return
+							}
+
 							if err := app.reloadRoutes(); err != nil {
 								log.Printf("Error applying reloaded routes: %v", err)
 							}
@@ -145,3 +267,15 @@ func (app *App) liveReloader() {
 
 	<-make(chan struct{})
 }
+
+// onlyContentChanged reports whether all the changed files are markdown files in the content directory
+func (app *App) onlyContentChanged(paths []string) bool {
+	contentDir := filepath.Join(app.Config.WebRoot, "content") + string(filepath.Separator)
+	for _, path := range paths {
+		ext := filepath.Ext(path)
+		if !strings.HasPrefix(path, contentDir) || (ext != ".md" && ext != ".markdown") {
+			return false
+		}
+	}
+	return len(paths) > 0
+}
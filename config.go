@@ -3,21 +3,95 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
 type Config struct {
-	Host          string `toml:"host"`
-	Port          int    `toml:"port"`
-	Db            string `toml:"db"`
-	WebRoot       string `toml:"web_root"`
-	LiveReload    bool   `toml:"live_reload"`
-	EnableAdmin   bool   `toml:"enable_admin"`
-	AdminUsername string `toml:"admin_username"`
-	AdminPassword string `toml:"admin_password"`
-	LoadDotenv    bool   `toml:"load_dotenv"`
-	EnvPrefix     string `toml:"env_prefix"`
+	Host          string   `toml:"host"`
+	Port          int      `toml:"port"`
+	Db            string   `toml:"db"`
+	WebRoot       string   `toml:"web_root"`
+	LiveReload    bool     `toml:"live_reload"`
+	EnableAdmin   bool     `toml:"enable_admin"`
+	AdminUsername string   `toml:"admin_username"`
+	AdminPassword string   `toml:"admin_password"`
+	LoadDotenv    bool     `toml:"load_dotenv"`
+	EnvPrefix     string   `toml:"env_prefix"`
+	TemplateEnv   []string `toml:"template_env"`
+	TemplateFuncs []string `toml:"template_functions"`
+	DevMode       bool     `toml:"dev_mode"`
+	ContentRoutes bool     `toml:"content_routes"`
+	ContentLayout string   `toml:"content_layout"`
+
+	ContentSearchTags    bool               `toml:"content_search_tags"`
+	ContentSearchFields  []string           `toml:"content_search_fields"`
+	ContentSearchWeights map[string]float64 `toml:"content_search_weights"`
+
+	MarkdownHighlight      bool   `toml:"markdown_highlight"`
+	MarkdownHighlightStyle string `toml:"markdown_highlight_style"`
+	MarkdownFootnotes      bool   `toml:"markdown_footnotes"`
+	MarkdownTypographer    bool   `toml:"markdown_typographer"`
+
+	Feeds       bool                        `toml:"feeds"`
+	SiteURL     string                      `toml:"site_url"`
+	SiteTitle   string                      `toml:"site_title"`
+	FeedLimit   int                         `toml:"feed_limit"`
+	Collections map[string]CollectionConfig `toml:"collections"`
+
+	RequestTimeout time.Duration `toml:"request_timeout"`
+	Timezone       string        `toml:"timezone"`
+
+	SecretKey string `toml:"secret_key"`
+
+	JWTKeys        map[string]JWTKeyConfig `toml:"jwt_keys"`
+	JWTJWKSFile    string                  `toml:"jwt_jwks_file"`
+	JWTDefaultKey  string                  `toml:"jwt_default_key"`
+	JWTIssuer      string                  `toml:"jwt_issuer"`
+	JWTAudience    string                  `toml:"jwt_audience"`
+	JWTTTL         time.Duration           `toml:"jwt_ttl"`
+	JWTLeeway      time.Duration           `toml:"jwt_leeway"`
+	JWTRequestAuth bool                    `toml:"jwt_request_auth"`
+
+	HTTPTimeout         time.Duration `toml:"http_timeout"`
+	HTTPMaxBodyBytes    int64         `toml:"http_max_body_bytes"`
+	HTTPFollowRedirects bool          `toml:"http_follow_redirects"`
+	HTTPMaxRedirects    int           `toml:"http_max_redirects"`
+	HTTPAllowHosts      []string      `toml:"http_allow_hosts"`
+	HTTPDenyHosts       []string      `toml:"http_deny_hosts"`
+	HTTPBlockPrivate    bool          `toml:"http_block_private"`
+	HTTPCache           bool          `toml:"http_cache"`
+	HTTPCacheDb         string        `toml:"http_cache_db"`
+	HTTPCassette        string        `toml:"http_cassette"`
+	HTTPCassetteDir     string        `toml:"http_cassette_dir"`
+}
+
+// CollectionConfig holds the feed and sitemap settings of a content collection
+type CollectionConfig struct {
+	Title       string `toml:"title"`
+	Description string `toml:"description"`
+	Feed        *bool  `toml:"feed"`
+	Sitemap     *bool  `toml:"sitemap"`
+	Limit       int    `toml:"limit"`
+}
+
+// JWTKeyConfig is a key for signing and verifying JSON Web Tokens
+type JWTKeyConfig struct {
+	Algorithm      string `toml:"algorithm"`
+	Secret         string `toml:"secret"`
+	PrivateKeyFile string `toml:"private_key_file"`
+	PublicKeyFile  string `toml:"public_key_file"`
+}
+
+// InFeeds reports whether the collection is included in feeds, which it is unless turned off
+func (c CollectionConfig) InFeeds() bool {
+	return c.Feed == nil || *c.Feed
+}
+
+// InSitemap reports whether the collection is included in the sitemap, which it is unless turned off
+func (c CollectionConfig) InSitemap() bool {
+	return c.Sitemap == nil || *c.Sitemap
 }
 
 func NewConfig() *Config {
@@ -32,6 +106,29 @@ func NewConfig() *Config {
 		AdminPassword: "wtfhttpd",
 		LoadDotenv:    true,
 		EnvPrefix:     "WTF_",
+		DevMode:       false,
+		ContentLayout: "content.html",
+		ContentSearchWeights: map[string]float64{
+			"title":   10,
+			"content": 1,
+			"tags":    5,
+			"fields":  2,
+		},
+		MarkdownHighlight:      true,
+		MarkdownHighlightStyle: "github",
+		MarkdownFootnotes:      true,
+		SiteTitle:              "wtfhttpd",
+		FeedLimit:              20,
+		Timezone:               "UTC",
+		JWTTTL:                 time.Hour,
+		JWTLeeway:              30 * time.Second,
+		HTTPTimeout:            30 * time.Second,
+		HTTPMaxBodyBytes:       10 << 20,
+		HTTPFollowRedirects:    true,
+		HTTPMaxRedirects:       10,
+		HTTPBlockPrivate:       true,
+		HTTPCacheDb:            "wtf_http_cache.db",
+		HTTPCassetteDir:        "cassettes",
 	}
 }
 
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nikolalohinski/gonja/v2/exec"
+)
+
+// contentListColumns are the columns of wtf_content returned by listings, leaving out the bodies
+const contentListColumns = "id, title, path, slug, collection, permalink, layout, date, tags, metadata"
+
+// contentCollection returns the collection of a content file, which is the
+// first directory it's in. Files at the top of the content directory have none.
+func contentCollection(relativePath string) string {
+	dir := filepath.ToSlash(filepath.Dir(relativePath))
+	if dir == "." {
+		return ""
+	}
+	return strings.SplitN(dir, "/", 2)[0]
+}
+
+// contentPermalink returns the URL a content file is served at, either from the
+// `permalink` front matter or from its directory and slug
+func contentPermalink(frontMatter map[string]any, relativePath, slug string) string {
+	permalink, _ := frontMatter["permalink"].(string)
+	if permalink == "" {
+		dir := filepath.ToSlash(filepath.Dir(relativePath))
+		if dir == "." {
+			dir = ""
+		}
+
+		permalink = dir
+		if slug != "index" {
+			permalink = dir + "/" + slug
+		}
+	}
+
+	permalink = "/" + strings.Trim(permalink, "/")
+	if permalink != "/" {
+		permalink += "/"
+	}
+	return permalink
+}
+
+// contentDate returns the date of a content file from the `date` front matter,
+// in the same format as SQLite's datetime(). The file's modification time is used
+// if it isn't set.
+func contentDate(frontMatter map[string]any, modTime time.Time) string {
+	switch date := frontMatter["date"].(type) {
+	case time.Time:
+		return date.UTC().Format("2006-01-02 15:04:05")
+	case string:
+		if t, err := parseTimeLayouts(date, datetimeLayouts); err == nil {
+			return t.UTC().Format("2006-01-02 15:04:05")
+		}
+		log.Printf("Invalid content date '%s', using the file's modification time", date)
+	}
+
+	return modTime.UTC().Format("2006-01-02 15:04:05")
+}
+
+// parseContentTags reads the `tags` front matter, given either as a list or as a comma separated string
+func parseContentTags(value any) []string {
+	var tags []string
+
+	switch v := value.(type) {
+	case string:
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	case []any:
+		for _, item := range v {
+			if tag := strings.TrimSpace(fmt.Sprint(item)); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	if tags == nil {
+		tags = []string{}
+	}
+	return tags
+}
+
+// setupContentRoutes serves every indexed content file at its permalink,
+// rendered through the layout chosen in its front matter or the default content layout
+func setupContentRoutes(app *App, routes *routeTable, mux *http.ServeMux) error {
+	// Until content is indexed for the first time, there's nothing to route
+	exists, err := contentTableExists(app)
+	if err != nil || !exists {
+		return err
+	}
+
+	rows, err := app.DB.Query("SELECT path, permalink, layout FROM wtf_content ORDER BY path")
+	if err != nil {
+		return fmt.Errorf("error querying content: %v", err)
+	}
+
+	type contentRoute struct {
+		path, permalink, layout string
+	}
+
+	var contentRoutes []contentRoute
+	for rows.Next() {
+		var route contentRoute
+		if err := rows.Scan(&route.path, &route.permalink, &route.layout); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning content row: %v", err)
+		}
+		contentRoutes = append(contentRoutes, route)
+	}
+	rows.Close()
+
+	for _, route := range contentRoutes {
+		cacheKey := filepath.ToSlash(filepath.Join("content", route.path))
+
+		layout := route.layout
+		if layout == "" {
+			layout = app.Config.ContentLayout
+		}
+
+		if _, ok := routes.tpl[layout]; !ok {
+			template, deps, err := app.loadTemplate(layout)
+			if err != nil {
+				log.Printf("Error loading layout %s for %s: %v", layout, cacheKey, err)
+				continue
+			}
+			routes.tpl[layout] = template
+			routes.tplDeps[layout] = deps
+		}
+
+		middleware, err := loadMiddleware(app, routes, cacheKey)
+		if err != nil {
+			log.Printf("Error loading middleware for %s: %v", cacheKey, err)
+			return err
+		}
+
+		routePath := strings.TrimSuffix(route.permalink, "/") + "/{$}"
+		if err := handleGetRoute(mux, routePath, createHandler(app, "/"+cacheKey, nil)); err != nil {
+			log.Printf("Error registering %s for %s: %v", route.permalink, cacheKey, err)
+			continue
+		}
+
+		routes.sqlCache[cacheKey] = ""
+		routes.contentLayouts[cacheKey] = layout
+		routes.middleware[cacheKey] = middleware
+
+		fmt.Printf("GET %s -> /%s\n", route.permalink, cacheKey)
+		_, err = app.DB.Exec("INSERT INTO wtf_routes (path, method, file) VALUES (?, ?, ?)",
+			routePath, "GET", "/"+cacheKey)
+		if err != nil {
+			fmt.Printf("Error inserting into wtf_routes table: %v\n", err)
+		}
+
+		app.totalRoutes.Add(1)
+	}
+
+	return nil
+}
+
+// contentTableExists reports whether content has been indexed at least once
+func contentTableExists(app *App) (bool, error) {
+	var exists bool
+	err := app.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'wtf_content')").Scan(&exists)
+	return exists, err
+}
+
+// handleGetRoute registers a GET route, reporting patterns that clash
+// with other routes as an error instead of panicking
+func handleGetRoute(mux *http.ServeMux, routePath string, handler http.HandlerFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	mux.HandleFunc("GET "+routePath, handler)
+	return nil
+}
+
+// contentContext loads the content file served by a route, along with the
+// previous and next content in its collection, for the route's template
+func contentContext(tx *sql.Tx, cacheKey string) (map[string]any, error) {
+	rows, err := executeQuery(tx, `
+		SELECT c.*, n.prev_id, n.next_id
+		FROM wtf_content c
+		JOIN wtf_content_nav n ON n.id = c.id
+		WHERE c.path = :path`,
+		map[string]any{"path": strings.TrimPrefix(cacheKey, "content/")})
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("content %s is no longer indexed", cacheKey)
+	}
+
+	page := decodeContentRow(rows[0])
+	contextData := map[string]any{"page": page, "prev": nil, "next": nil}
+
+	for _, key := range []string{"prev", "next"} {
+		id := page[key+"_id"]
+		if id == nil {
+			continue
+		}
+
+		rows, err := executeQuery(tx, "SELECT "+contentListColumns+" FROM wtf_content WHERE id = :id", map[string]any{"id": id})
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 {
+			contextData[key] = decodeContentRow(rows[0])
+		}
+	}
+
+	return contextData, nil
+}
+
+// decodeContentRow decodes the JSON tags, metadata and toc columns of a content row
+func decodeContentRow(row map[string]any) map[string]any {
+	for _, column := range []string{"tags", "metadata", "toc"} {
+		if value, ok := row[column].(string); ok {
+			var decoded any
+			if err := json.Unmarshal([]byte(value), &decoded); err == nil {
+				row[column] = jsonIntegers(decoded)
+			}
+		}
+	}
+	return row
+}
+
+// contentList returns the content_list(collection, tag, limit) template function,
+// which lists content from the newest to the oldest, without the bodies
+func contentList(app *App) func(*exec.VarArgs) *exec.Value {
+	return func(args *exec.VarArgs) *exec.Value {
+		p := args.ExpectKwArgs([]*exec.KwArg{{Name: "collection", Default: nil}, {Name: "tag", Default: nil}, {Name: "limit", Default: 0}})
+		if p.IsError() {
+			return exec.AsValue(exec.ErrInvalidCall(fmt.Errorf("wrong signature for 'content_list': %s", p.Error())))
+		}
+
+		query := "SELECT " + contentListColumns + " FROM wtf_content WHERE 1 = 1"
+		var params []any
+
+		if collection := p.KwArgs["collection"]; !collection.IsNil() {
+			query += " AND collection = ?"
+			params = append(params, collection.String())
+		}
+
+		if tag := p.KwArgs["tag"]; !tag.IsNil() {
+			query += " AND id IN (SELECT content_id FROM wtf_content_tags WHERE tag = ?)"
+			params = append(params, tag.String())
+		}
+
+		query += " ORDER BY date DESC, path"
+
+		if limit := p.KwArgs["limit"].Integer(); limit > 0 {
+			query += fmt.Sprintf(" LIMIT %d", limit)
+		}
+
+		rows, err := queryContentRows(app, query, params...)
+		if err != nil {
+			return exec.AsValue(err)
+		}
+		return exec.AsValue(rows)
+	}
+}
+
+// contentTagList returns the content_tags(collection) template function,
+// which lists every tag along with how many content files use it
+func contentTagList(app *App) func(*exec.VarArgs) *exec.Value {
+	return func(args *exec.VarArgs) *exec.Value {
+		p := args.ExpectKwArgs([]*exec.KwArg{{Name: "collection", Default: nil}})
+		if p.IsError() {
+			return exec.AsValue(exec.ErrInvalidCall(fmt.Errorf("wrong signature for 'content_tags': %s", p.Error())))
+		}
+
+		query := `
+			SELECT t.tag, COUNT(*) AS count
+			FROM wtf_content_tags t
+			JOIN wtf_content c ON c.id = t.content_id`
+		var params []any
+
+		if collection := p.KwArgs["collection"]; !collection.IsNil() {
+			query += " WHERE c.collection = ?"
+			params = append(params, collection.String())
+		}
+
+		query += " GROUP BY t.tag ORDER BY count DESC, t.tag"
+
+		rows, err := queryContentRows(app, query, params...)
+		if err != nil {
+			return exec.AsValue(err)
+		}
+		return exec.AsValue(rows)
+	}
+}
+
+// contentSearch returns the content_search(query, limit, collection) template function,
+// which searches content through the wtf_content_search view, from the best match
+func contentSearch(app *App) func(*exec.VarArgs) *exec.Value {
+	return func(args *exec.VarArgs) *exec.Value {
+		p := args.Expect(1, []*exec.KwArg{{Name: "limit", Default: 10}, {Name: "collection", Default: nil}})
+		if p.IsError() {
+			return exec.AsValue(exec.ErrInvalidCall(fmt.Errorf("wrong signature for 'content_search': %s", p.Error())))
+		}
+
+		searchQuery := strings.TrimSpace(p.Args[0].String())
+		if p.Args[0].IsNil() || searchQuery == "" {
+			return exec.AsValue([]map[string]any{})
+		}
+
+		query := "SELECT " + contentListColumns + ", rank, title_highlight, snippet FROM wtf_content_search WHERE query MATCH ?"
+		params := []any{searchQuery}
+
+		if collection := p.KwArgs["collection"]; !collection.IsNil() {
+			query += " AND collection = ?"
+			params = append(params, collection.String())
+		}
+
+		query += " ORDER BY rank"
+
+		if limit := p.KwArgs["limit"].Integer(); limit > 0 {
+			query += fmt.Sprintf(" LIMIT %d", limit)
+		}
+
+		rows, err := queryContentRows(app, query, params...)
+		if err != nil {
+			return exec.AsValue(err)
+		}
+		return exec.AsValue(rows)
+	}
+}
+
+// queryContentRows runs a content query outside of the request transaction
+func queryContentRows(app *App, query string, params ...any) ([]map[string]any, error) {
+	rows, err := app.DB.Query(query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying content: %v", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting columns: %v", err)
+	}
+
+	results := []map[string]any{}
+	for rows.Next() {
+		values := make([]any, len(columns))
+		valuePtrs := make([]any, len(columns))
+		for i := range values {
+			valuePtrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, fmt.Errorf("Error scanning row: %v", err)
+		}
+
+		row := make(map[string]any)
+		for i, column := range columns {
+			if b, ok := values[i].([]byte); ok {
+				row[column] = string(b)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		results = append(results, decodeContentRow(row))
+	}
+
+	return results, rows.Err()
+}
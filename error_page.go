@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikolalohinski/gonja/v2"
+	"github.com/nikolalohinski/gonja/v2/exec"
+)
+
+// templateErrorLineRegex finds the line number in gonja's parse and render errors
+var templateErrorLineRegex = regexp.MustCompile(`(?i)line:? (\d+)`)
+
+// sourceContextLines is how many lines around the failing line the error page shows
+const sourceContextLines = 8
+
+// genericErrorPage is shown instead of the developer error page when dev_mode is off
+const genericErrorPage = `<!DOCTYPE html>
+<html>
+<head><title>500 Internal Server Error</title></head>
+<body>
+<h1>Internal Server Error</h1>
+<p>Something went wrong while rendering this page.</p>
+</body>
+</html>
+`
+
+// writeTemplateError sends the response for a template that failed to render.
+// In dev mode it shows the template source around the failing line, the
+// context keys and the queries of the route. Otherwise a generic 500 page is sent.
+func (app *App) writeTemplateError(w http.ResponseWriter, routeFile, tplName string, renderErr error, contextData map[string]any) {
+	log.Printf("Error rendering template %s for %s: %v", tplName, routeFile, renderErr)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Del("Content-Length")
+
+	if !app.Config.DevMode {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, genericErrorPage)
+		return
+	}
+
+	startTime := time.Now()
+
+	tpl, err := gonja.FromFile("./templates/error.html")
+	if err != nil {
+		log.Printf("Error loading error page template: %v", err)
+		http.Error(w, "Error rendering template: "+renderErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	line := 0
+	if match := templateErrorLineRegex.FindStringSubmatch(renderErr.Error()); match != nil {
+		line, _ = strconv.Atoi(match[1])
+	}
+
+	var keys []map[string]any
+	for key, value := range contextData {
+		keys = append(keys, map[string]any{"name": key, "type": describeContextValue(value)})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i]["name"].(string) < keys[j]["name"].(string)
+	})
+
+	tplData := exec.NewContext(map[string]any{
+		"error":      renderErr.Error(),
+		"template":   tplName,
+		"route_file": routeFile,
+		"line":       line,
+		"source":     templateSourceLines(app, tplName, line),
+		"keys":       keys,
+		"queries":    routeQueries(app, routeFile),
+		"render_ms":  time.Since(startTime).Milliseconds(),
+	})
+
+	page, err := tpl.ExecuteToString(tplData)
+	if err != nil {
+		log.Printf("Error executing error page template: %v", err)
+		http.Error(w, "Error rendering template: "+renderErr.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprint(w, page)
+}
+
+// templateSourceLines returns the lines of the template around the failing line.
+// Without a line number, the start of the template is shown.
+func templateSourceLines(app *App, tplName string, line int) []map[string]any {
+	content, err := os.ReadFile(filepath.Join(app.Config.WebRoot, tplName))
+	if err != nil {
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+
+	start, end := 1, min(len(lines), 2*sourceContextLines+1)
+	if line > 0 {
+		start = max(1, line-sourceContextLines)
+		end = min(len(lines), line+sourceContextLines)
+	}
+
+	var source []map[string]any
+	for number := start; number <= end; number++ {
+		source = append(source, map[string]any{
+			"number":  number,
+			"text":    lines[number-1],
+			"failing": number == line,
+		})
+	}
+	return source
+}
+
+// routeQueries lists the queries that ran for a route, and where their results were stored
+func routeQueries(app *App, routeFile string) []map[string]any {
+	routes := app.currentRoutes()
+	middleware := routes.middleware[routeFile]
+
+	var files []string
+	files = append(files, middleware.before...)
+	files = append(files, routeFile)
+	files = append(files, middleware.after...)
+	files = append(files, globalsFile)
+
+	var queries []map[string]any
+	for _, file := range files {
+		content, ok := routes.sqlCache[file]
+		if !ok {
+			continue
+		}
+
+		for _, query := range ParseQueries(content) {
+			storedAs := ""
+			switch {
+			case file == routeFile:
+				storedAs = "ctx"
+			case file == globalsFile:
+				storedAs = "globals"
+			}
+
+			for _, directive := range query.Directives {
+				if directive.name == "store" && len(directive.params) > 0 {
+					storedAs = directive.params[0]
+					break
+				}
+			}
+
+			queries = append(queries, map[string]any{
+				"file":      file,
+				"stored_as": storedAs,
+				"sql":       query.Query,
+			})
+		}
+	}
+
+	return queries
+}
+
+// describeContextValue gives a short description of a template context value
+func describeContextValue(value any) string {
+	switch v := value.(type) {
+	case []map[string]any:
+		return fmt.Sprintf("%d rows", len(v))
+	case map[string]any:
+		return fmt.Sprintf("dict (%d keys)", len(v))
+	case map[string]string:
+		return fmt.Sprintf("dict (%d keys)", len(v))
+	case func(*exec.VarArgs) *exec.Value:
+		return "function"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
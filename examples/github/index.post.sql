@@ -3,6 +3,9 @@
 SELECT
     cache_get('github_user_' || @username);
 
+-- Responses are kept in the in-memory cache, so the example works with the default
+-- config. With http_cache = true, the HTTP cache also keeps them for as long as
+-- GitHub's Cache-Control allows, and revalidates them with their ETag after that.
 -- @wtf-capture api_response single
 SELECT
     CASE
@@ -34,10 +37,11 @@ SELECT
     json_extract(@user, '$.name') as name,
     CASE
         WHEN @cached_data IS NOT NULL THEN 'HIT'
+        WHEN json_extract(@api_response, '$.cache') IN ('hit', 'revalidated') THEN 'HIT'
         ELSE 'MISS'
     END as cache_status;
 
 INSERT INTO
     response_meta (name, value)
 VALUES
-    ("wtf-tpl", "github/index.html")
\ No newline at end of file
+    ("wtf-tpl", "github/index.html")
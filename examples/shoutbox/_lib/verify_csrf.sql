@@ -0,0 +1,14 @@
+-- @wtf-validate csrf_token required,len=64
+-- Check if CSRF token is invalid
+SELECT
+    wtf_abort(403, 'Invalid CSRF token')
+WHERE
+    NOT EXISTS (
+        SELECT
+            value
+        FROM
+            request_cookies
+        WHERE
+            name = 'csrf_token'
+            AND value = @csrf_token
+    );
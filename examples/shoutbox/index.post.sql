@@ -1,19 +1,6 @@
 -- @wtf-validate name required,max=64
 -- @wtf-validate comment required,max=512
--- @wtf-validate csrf_token required,len=64
--- Check if CSRF token is invalid
-SELECT
-    wtf_abort(403, 'Invalid CSRF token')
-WHERE
-    NOT EXISTS (
-        SELECT
-            value
-        FROM
-            request_cookies
-        WHERE
-            name = 'csrf_token'
-            AND value = @csrf_token
-    );
+-- @wtf-include shoutbox/_lib/verify_csrf.sql
 
 INSERT INTO
     shoutbox (name, comment, created_at)
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// feedItem is a content file as it appears in feeds
+type feedItem struct {
+	Title   string
+	URL     string
+	Summary string
+	Author  string
+	HTML    string
+	Tags    []string
+	Date    time.Time
+}
+
+// feedFormat writes a feed in one of the supported formats
+type feedFormat func(w *bytes.Buffer, meta feedMeta, items []feedItem) error
+
+// feedMeta describes the feed itself
+type feedMeta struct {
+	Title       string
+	Description string
+	SiteURL     string
+	FeedURL     string
+	Updated     time.Time
+}
+
+// setupFeedRoutes serves the RSS, Atom and JSON feeds of the content, for the
+// whole site and for every collection, along with the sitemap
+func setupFeedRoutes(app *App, mux *http.ServeMux) {
+	routes := []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/feed.xml", app.serveFeed(writeRSSFeed, "application/rss+xml; charset=utf-8")},
+		{"/atom.xml", app.serveFeed(writeAtomFeed, "application/atom+xml; charset=utf-8")},
+		{"/feed.json", app.serveFeed(writeJSONFeed, "application/feed+json; charset=utf-8")},
+		{"/{collection}/feed.xml", app.serveFeed(writeRSSFeed, "application/rss+xml; charset=utf-8")},
+		{"/{collection}/atom.xml", app.serveFeed(writeAtomFeed, "application/atom+xml; charset=utf-8")},
+		{"/{collection}/feed.json", app.serveFeed(writeJSONFeed, "application/feed+json; charset=utf-8")},
+		{"/sitemap.xml", app.serveSitemap},
+	}
+
+	for _, route := range routes {
+		if err := handleGetRoute(mux, route.path, route.handler); err != nil {
+			log.Printf("Error registering %s: %v", route.path, err)
+			continue
+		}
+		fmt.Printf("GET %s -> (feeds)\n", route.path)
+	}
+}
+
+// serveFeed returns the handler of a feed format. Feeds of a collection only
+// include that collection, and the site feed every collection that isn't turned off.
+func (app *App) serveFeed(format feedFormat, contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		collection := r.PathValue("collection")
+		settings := app.Config.Collections[collection]
+
+		if !settings.InFeeds() {
+			http.NotFound(w, r)
+			return
+		}
+
+		limit := app.Config.FeedLimit
+		if settings.Limit > 0 {
+			limit = settings.Limit
+		}
+
+		siteURL := app.siteURL(r)
+		items, err := app.feedItems(siteURL, collection, limit)
+		if err != nil {
+			log.Printf("Error loading feed items: %v", err)
+			http.Error(w, "Error loading feed", http.StatusInternalServerError)
+			return
+		}
+		if collection != "" && len(items) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		meta := feedMeta{
+			Title:       app.Config.SiteTitle,
+			Description: settings.Description,
+			SiteURL:     siteURL + "/",
+			FeedURL:     siteURL + r.URL.Path,
+		}
+		if collection != "" {
+			meta.SiteURL = siteURL + "/" + collection + "/"
+			meta.Title = app.Config.SiteTitle + " - " + collection
+		}
+		if settings.Title != "" {
+			meta.Title = settings.Title
+		}
+		if len(items) > 0 {
+			meta.Updated = items[0].Date
+		}
+
+		var buf bytes.Buffer
+		if err := format(&buf, meta, items); err != nil {
+			log.Printf("Error writing feed: %v", err)
+			http.Error(w, "Error writing feed", http.StatusInternalServerError)
+			return
+		}
+
+		serveCacheable(w, r, contentType, meta.Updated, buf.Bytes())
+	}
+}
+
+// serveCacheable sends a generated document with an ETag, so clients can revalidate it
+func serveCacheable(w http.ResponseWriter, r *http.Request, contentType string, modTime time.Time, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	sum := sha256.Sum256(body)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum[:16]))
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
+
+// siteURL returns the base URL of the site, from the config or from the request
+func (app *App) siteURL(r *http.Request) string {
+	if app.Config.SiteURL != "" {
+		return strings.TrimSuffix(app.Config.SiteURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// feedItems loads the newest content for a feed, leaving out drafts
+func (app *App) feedItems(siteURL, collection string, limit int) ([]feedItem, error) {
+	exists, err := contentTableExists(app)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	query := `
+		SELECT title, permalink, collection, date, tags, metadata, html_body
+		FROM wtf_content
+		WHERE COALESCE(json_extract(metadata, '$.draft'), 0) = 0`
+	var params []any
+
+	if collection != "" {
+		query += " AND collection = ?"
+		params = append(params, collection)
+	}
+	query += " ORDER BY date DESC, path"
+
+	rows, err := queryContentRows(app, query, params...)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []feedItem
+	for _, row := range rows {
+		if len(items) >= limit {
+			break
+		}
+
+		itemCollection, _ := row["collection"].(string)
+		if !app.Config.Collections[itemCollection].InFeeds() {
+			continue
+		}
+
+		item := feedItem{
+			Title: fmt.Sprint(row["title"]),
+			URL:   siteURL + fmt.Sprint(row["permalink"]),
+		}
+		item.Date, _ = time.Parse("2006-01-02 15:04:05", fmt.Sprint(row["date"]))
+
+		if metadata, ok := row["metadata"].(map[string]any); ok {
+			if summary, ok := metadata["summary"].(string); ok {
+				item.Summary = summary
+			} else if description, ok := metadata["description"].(string); ok {
+				item.Summary = description
+			}
+			item.Author, _ = metadata["author"].(string)
+		}
+
+		if tags, ok := row["tags"].([]any); ok {
+			for _, tag := range tags {
+				item.Tags = append(item.Tags, fmt.Sprint(tag))
+			}
+		}
+
+		htmlBody, _ := row["html_body"].(string)
+		item.HTML = app.expandShortcodes(htmlBody, map[string]any{"page": row})
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// writeRSSFeed writes an RSS 2.0 feed
+func writeRSSFeed(w *bytes.Buffer, meta feedMeta, items []feedItem) error {
+	type rssItem struct {
+		Title       string   `xml:"title"`
+		Link        string   `xml:"link"`
+		GUID        string   `xml:"guid"`
+		PubDate     string   `xml:"pubDate"`
+		Author      string   `xml:"author,omitempty"`
+		Categories  []string `xml:"category"`
+		Description string   `xml:"description"`
+	}
+
+	type rssAtomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+		Type string `xml:"type,attr"`
+	}
+
+	type rssChannel struct {
+		Title         string      `xml:"title"`
+		Link          string      `xml:"link"`
+		Description   string      `xml:"description"`
+		LastBuildDate string      `xml:"lastBuildDate,omitempty"`
+		AtomLink      rssAtomLink `xml:"atom:link"`
+		Items         []rssItem   `xml:"item"`
+	}
+
+	type rssFeed struct {
+		XMLName xml.Name   `xml:"rss"`
+		Version string     `xml:"version,attr"`
+		Atom    string     `xml:"xmlns:atom,attr"`
+		Channel rssChannel `xml:"channel"`
+	}
+
+	feed := rssFeed{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:       meta.Title,
+			Link:        meta.SiteURL,
+			Description: meta.Description,
+			AtomLink:    rssAtomLink{Href: meta.FeedURL, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+	if !meta.Updated.IsZero() {
+		feed.Channel.LastBuildDate = meta.Updated.Format(time.RFC1123Z)
+	}
+
+	for _, item := range items {
+		description := item.HTML
+		if description == "" {
+			description = item.Summary
+		}
+
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       item.Title,
+			Link:        item.URL,
+			GUID:        item.URL,
+			PubDate:     item.Date.Format(time.RFC1123Z),
+			Author:      item.Author,
+			Categories:  item.Tags,
+			Description: description,
+		})
+	}
+
+	return writeXML(w, feed)
+}
+
+// writeAtomFeed writes an Atom 1.0 feed
+func writeAtomFeed(w *bytes.Buffer, meta feedMeta, items []feedItem) error {
+	type atomLink struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr,omitempty"`
+	}
+
+	type atomText struct {
+		Type string `xml:"type,attr"`
+		Body string `xml:",chardata"`
+	}
+
+	type atomAuthor struct {
+		Name string `xml:"name"`
+	}
+
+	type atomCategory struct {
+		Term string `xml:"term,attr"`
+	}
+
+	type atomEntry struct {
+		Title      string         `xml:"title"`
+		ID         string         `xml:"id"`
+		Updated    string         `xml:"updated"`
+		Link       atomLink       `xml:"link"`
+		Author     *atomAuthor    `xml:"author,omitempty"`
+		Categories []atomCategory `xml:"category"`
+		Summary    *atomText      `xml:"summary,omitempty"`
+		Content    atomText       `xml:"content"`
+	}
+
+	type atomFeed struct {
+		XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+		Title    string      `xml:"title"`
+		Subtitle string      `xml:"subtitle,omitempty"`
+		ID       string      `xml:"id"`
+		Updated  string      `xml:"updated"`
+		Links    []atomLink  `xml:"link"`
+		Author   atomAuthor  `xml:"author"`
+		Entries  []atomEntry `xml:"entry"`
+	}
+
+	updated := meta.Updated
+	if updated.IsZero() {
+		updated = time.Now()
+	}
+
+	feed := atomFeed{
+		Title:    meta.Title,
+		Subtitle: meta.Description,
+		ID:       meta.SiteURL,
+		Updated:  updated.UTC().Format(time.RFC3339),
+		Links:    []atomLink{{Href: meta.SiteURL}, {Href: meta.FeedURL, Rel: "self"}},
+		Author:   atomAuthor{Name: meta.Title},
+	}
+
+	for _, item := range items {
+		entry := atomEntry{
+			Title:   item.Title,
+			ID:      item.URL,
+			Updated: item.Date.UTC().Format(time.RFC3339),
+			Link:    atomLink{Href: item.URL},
+			Content: atomText{Type: "html", Body: item.HTML},
+		}
+		if item.Author != "" {
+			entry.Author = &atomAuthor{Name: item.Author}
+		}
+		if item.Summary != "" {
+			entry.Summary = &atomText{Type: "text", Body: item.Summary}
+		}
+		for _, tag := range item.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	return writeXML(w, feed)
+}
+
+// writeJSONFeed writes a JSON Feed 1.1 feed
+func writeJSONFeed(w *bytes.Buffer, meta feedMeta, items []feedItem) error {
+	type jsonFeedAuthor struct {
+		Name string `json:"name"`
+	}
+
+	type jsonFeedItem struct {
+		ID            string           `json:"id"`
+		URL           string           `json:"url"`
+		Title         string           `json:"title"`
+		ContentHTML   string           `json:"content_html"`
+		Summary       string           `json:"summary,omitempty"`
+		DatePublished string           `json:"date_published"`
+		Tags          []string         `json:"tags,omitempty"`
+		Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	}
+
+	type jsonFeed struct {
+		Version     string         `json:"version"`
+		Title       string         `json:"title"`
+		HomePageURL string         `json:"home_page_url"`
+		FeedURL     string         `json:"feed_url"`
+		Description string         `json:"description,omitempty"`
+		Items       []jsonFeedItem `json:"items"`
+	}
+
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       meta.Title,
+		HomePageURL: meta.SiteURL,
+		FeedURL:     meta.FeedURL,
+		Description: meta.Description,
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, item := range items {
+		feedItem := jsonFeedItem{
+			ID:            item.URL,
+			URL:           item.URL,
+			Title:         item.Title,
+			ContentHTML:   item.HTML,
+			Summary:       item.Summary,
+			DatePublished: item.Date.UTC().Format(time.RFC3339),
+			Tags:          item.Tags,
+		}
+		if item.Author != "" {
+			feedItem.Authors = []jsonFeedAuthor{{Name: item.Author}}
+		}
+		feed.Items = append(feed.Items, feedItem)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(feed)
+}
+
+// sitemapURL is a single URL in the sitemap
+type sitemapURL struct {
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod,omitempty"`
+	ChangeFreq string `xml:"changefreq,omitempty"`
+	Priority   string `xml:"priority,omitempty"`
+}
+
+// serveSitemap serves the sitemap of the content served by content routes, and of the
+// routes that add themselves with the @wtf-sitemap directive
+func (app *App) serveSitemap(w http.ResponseWriter, r *http.Request) {
+	siteURL := app.siteURL(r)
+
+	var urls []sitemapURL
+	seen := make(map[string]bool)
+	add := func(u sitemapURL) {
+		if !strings.HasPrefix(u.Loc, "http://") && !strings.HasPrefix(u.Loc, "https://") {
+			u.Loc = siteURL + "/" + strings.TrimPrefix(u.Loc, "/")
+		}
+		if !seen[u.Loc] {
+			seen[u.Loc] = true
+			urls = append(urls, u)
+		}
+	}
+
+	routeURLs, err := app.sitemapRouteURLs()
+	if err != nil {
+		log.Printf("Error loading sitemap routes: %v", err)
+		http.Error(w, "Error loading sitemap", http.StatusInternalServerError)
+		return
+	}
+	for _, u := range routeURLs {
+		add(u)
+	}
+
+	var modTime time.Time
+	if exists, err := contentTableExists(app); err == nil && exists && app.Config.ContentRoutes {
+		rows, err := queryContentRows(app, `
+			SELECT permalink, collection, date
+			FROM wtf_content
+			WHERE COALESCE(json_extract(metadata, '$.draft'), 0) = 0
+			ORDER BY permalink`)
+		if err != nil {
+			log.Printf("Error loading sitemap content: %v", err)
+			http.Error(w, "Error loading sitemap", http.StatusInternalServerError)
+			return
+		}
+
+		for _, row := range rows {
+			collection, _ := row["collection"].(string)
+			if !app.Config.Collections[collection].InSitemap() {
+				continue
+			}
+
+			date, _ := time.Parse("2006-01-02 15:04:05", fmt.Sprint(row["date"]))
+			if date.After(modTime) {
+				modTime = date
+			}
+			add(sitemapURL{Loc: fmt.Sprint(row["permalink"]), LastMod: date.Format("2006-01-02")})
+		}
+	}
+
+	urlSet := struct {
+		XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+		URLs    []sitemapURL `xml:"url"`
+	}{URLs: urls}
+
+	var buf bytes.Buffer
+	if err := writeXML(&buf, urlSet); err != nil {
+		log.Printf("Error writing sitemap: %v", err)
+		http.Error(w, "Error writing sitemap", http.StatusInternalServerError)
+		return
+	}
+
+	serveCacheable(w, r, "application/xml; charset=utf-8", modTime, buf.Bytes())
+}
+
+// sitemapRouteURLs lists the URLs that GET routes add to the sitemap. A route with
+// `-- @wtf-sitemap` adds its own path, and `-- @wtf-sitemap <file.sql>` runs the SQL file,
+// which returns a `loc` column and optionally `lastmod`, `changefreq` and `priority`.
+// Pages do the same with the `sitemap` front matter key, set to true or a SQL file.
+func (app *App) sitemapRouteURLs() ([]sitemapURL, error) {
+	rows, err := app.DB.Query("SELECT path, file FROM wtf_routes WHERE method IN ('GET', 'ANY') ORDER BY path")
+	if err != nil {
+		return nil, err
+	}
+
+	type route struct {
+		path, file string
+	}
+
+	var routes []route
+	for rows.Next() {
+		var r route
+		if err := rows.Scan(&r.path, &r.file); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		routes = append(routes, r)
+	}
+	rows.Close()
+
+	table := app.currentRoutes()
+
+	var urls []sitemapURL
+	for _, r := range routes {
+		cacheKey := strings.TrimPrefix(r.file, "/")
+
+		enabled, file := false, ""
+		if frontMatter, ok := table.pages[cacheKey]; ok {
+			switch value := frontMatter["sitemap"].(type) {
+			case bool:
+				enabled = value
+			case string:
+				enabled, file = true, value
+			}
+		} else if directive, ok := FindDirective(table.sqlCache[cacheKey], "sitemap"); ok {
+			enabled = true
+			if len(directive.params) > 0 {
+				file = directive.params[0]
+			}
+		}
+
+		if !enabled {
+			continue
+		}
+
+		if file == "" {
+			path := strings.TrimSuffix(r.path, "{$}")
+			if strings.Contains(path, "{") {
+				log.Printf("Not adding %s to the sitemap: routes with path params need a SQL file listing their URLs", cacheKey)
+				continue
+			}
+			urls = append(urls, sitemapURL{Loc: path})
+			continue
+		}
+
+		results, err := app.queryFile(file, nil)
+		if err != nil {
+			log.Printf("Error listing sitemap URLs of %s: %v", cacheKey, err)
+			continue
+		}
+
+		for _, row := range results {
+			u := sitemapURL{Loc: sitemapValue(row["loc"])}
+			if u.Loc == "" {
+				continue
+			}
+			u.LastMod = sitemapValue(row["lastmod"])
+			u.ChangeFreq = sitemapValue(row["changefreq"])
+			u.Priority = sitemapValue(row["priority"])
+			urls = append(urls, u)
+		}
+	}
+
+	return urls, nil
+}
+
+// sitemapValue formats a column of a sitemap query, which may be missing
+func sitemapValue(value any) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// writeXML writes a document with the XML declaration
+func writeXML(w *bytes.Buffer, document any) error {
+	w.WriteString(xml.Header)
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+
+	w.WriteString("\n")
+	return nil
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
+	ut "github.com/go-playground/universal-translator"
 	"github.com/nikolalohinski/gonja/v2/exec"
+	"github.com/sad-pixel/wtfhttpd/udfs"
 )
 
 func createHandler(app *App, path string, pathParams []string) http.HandlerFunc {
@@ -17,12 +22,22 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 		app.hitsProcessed.Add(1)
 		// Trim the leading slash for consistency with cache keys
 		trimmedPath := strings.TrimPrefix(path, "/")
-		content, ok := app.sqlCache[trimmedPath]
+		// The whole request is served from the routes loaded when it arrived
+		routes := app.currentRoutes()
+		content, ok := routes.sqlCache[trimmedPath]
 		if !ok {
 			http.Error(w, "Route not found in cache: "+trimmedPath, http.StatusNotFound)
 			return
 		}
 
+		// The request's context ends when the client goes away or the route times out.
+		// UDFs see it, so outbound calls made by the route are cancelled with it.
+		ctx, cancel := routeContext(app, r, content)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		requestID := newRequestID(r)
+		w.Header().Set("X-Request-Id", requestID)
 		conn, err := app.DB.Conn(r.Context())
 		if err != nil { /* handle error */
 			http.Error(w, "Error connecting database: "+err.Error(), http.StatusInternalServerError)
@@ -30,20 +45,37 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 		}
 		defer conn.Close()
 
-		_, err = conn.ExecContext(r.Context(), "ATTACH DATABASE ':memory:' AS wtfhttpd;")
+		// The connection outlives the request's context, so a cancelled request still rolls back
+		// and detaches before the connection goes back to the pool. The statements run while it's
+		// bound to the request are interrupted instead.
+		connCtx := context.WithoutCancel(r.Context())
+
+		_, err = conn.ExecContext(connCtx, "ATTACH DATABASE ':memory:' AS wtfhttpd;")
 		if err != nil { /* handle error */
 			http.Error(w, "Error attaching in-memory database: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		defer func() {
-			if _, err := conn.ExecContext(r.Context(), "DETACH DATABASE wtfhttpd;"); err != nil {
+			if _, err := conn.ExecContext(connCtx, "DETACH DATABASE wtfhttpd;"); err != nil {
 				log.Printf("Error detaching in-memory database: %v", err)
 			}
 		}()
 
+		bound, err := udfs.BindRequest(conn, ctx, udfs.RequestInfo{
+			ID:     requestID,
+			Route:  path,
+			Method: r.Method,
+			Path:   r.URL.Path,
+		})
+		if err != nil {
+			http.Error(w, "Error binding database connection: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer bound.Unbind()
+
 		// Create a transaction to work with temporary tables
-		tx, err := conn.BeginTx(r.Context(), nil)
+		tx, err := conn.BeginTx(connCtx, nil)
 		if err != nil {
 			http.Error(w, "Error starting transaction: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -51,14 +83,21 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 		defer tx.Rollback() // Will be ignored if transaction is committed
 
 		if err := setupTemporaryTables(tx); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeQueryError(w, r, http.StatusInternalServerError, err)
 			return
 		}
 
-		if err := populateTemporaryTables(tx, r, pathParams, app.Config); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := populateTemporaryTables(tx, r, pathParams, app.Config, app.flashKey, wantsRawBody(routes, trimmedPath, content)); err != nil {
+			writeQueryError(w, r, http.StatusInternalServerError, err)
 			return
 		}
+
+		if app.Config.JWTRequestAuth {
+			if err := populateRequestAuth(tx, r, app.jwt); err != nil {
+				writeQueryError(w, r, http.StatusInternalServerError, err)
+				return
+			}
+		}
 		varsMap := make(map[string]interface{})
 
 		// First add path parameters (highest precedence)
@@ -109,82 +148,27 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 			}
 		}
 
-		parsedQueries := ParseQueries(string(content))
 		results := make(map[string][]map[string]any)
+		trans := app.translatorFor(r)
+		middleware := routes.middleware[trimmedPath]
 
-		for _, query := range parsedQueries {
-			validations := make(map[string]any)
-
-			// log.Printf("Processing query: %s\n", query.Query)
-			// if len(query.Directives) > 0 {
-			// 	log.Printf("Query directives: %+v\n", query.Directives)
-			// }
-
-			for _, directive := range query.Directives {
-				if directive.name == "validate" && len(directive.params) >= 2 {
-					validations[directive.params[0]] = directive.params[1]
-				}
-			}
-
-			if len(validations) > 0 {
-				errs := app.vd.ValidateMap(varsMap, validations)
-				if len(errs) > 0 {
-					// Validation failed
-					// log.Printf("%+v", errs)
-					http.Error(w, fmt.Sprintf("Validation error: %v", errs), http.StatusBadRequest)
-					return
-				}
-
-				// log.Printf("Validation passed for fields: %v", validations)
-			}
-
-			result, err := executeQuery(tx, query.Query, varsMap)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Middleware and the route share the transaction, the bound variables and the results
+		for _, file := range middleware.before {
+			if code, err := executeQueries(app, tx, trans, ParseQueries(routes.sqlCache[file]), varsMap, results, false); err != nil {
+				writeQueryError(w, r, code, err)
 				return
 			}
+		}
 
-			// Check for store directive
-			storeDirectiveFound := false
-			for _, directive := range query.Directives {
-				if directive.name == "store" && len(directive.params) > 0 {
-					// Store the result under the specified key
-					storeKey := directive.params[0]
-					results[storeKey] = result
-					// log.Printf("Stored query result in '%s'", storeKey)
-					storeDirectiveFound = true
-					break
-				}
-			}
-
-			// If no store directive was found, store the result in the "ctx" key
-			if !storeDirectiveFound {
-				results["ctx"] = result
-				// log.Printf("No store directive found, stored query result in 'ctx'")
-			}
-
-			for _, directive := range query.Directives {
-				if directive.name == "capture" && len(directive.params) > 0 {
-					varName := directive.params[0]
-					isScalar := false
-					if len(directive.params) == 2 && directive.params[1] == "single" {
-						isScalar = true
-					}
+		if code, err := executeQueries(app, tx, trans, ParseQueries(content), varsMap, results, true); err != nil {
+			writeQueryError(w, r, code, err)
+			return
+		}
 
-					if isScalar && len(result) > 0 {
-						// For scalar, get the first value of the first row
-						for _, val := range result[0] {
-							varsMap[varName] = val
-							break
-						}
-					} else {
-						// Otherwise store the entire result set as JSON
-						jsonData, err := json.Marshal(result)
-						if err == nil {
-							varsMap[varName] = string(jsonData)
-						}
-					}
-				}
+		for _, file := range middleware.after {
+			if code, err := executeQueries(app, tx, trans, ParseQueries(routes.sqlCache[file]), varsMap, results, false); err != nil {
+				writeQueryError(w, r, code, err)
+				return
 			}
 		}
 
@@ -193,6 +177,12 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 
 		rows, err := tx.Query("SELECT name, value FROM response_meta")
 		tplName := ""
+		// Pages render themselves unless their queries pick another template
+		if isPagePath(trimmedPath) {
+			tplName = trimmedPath
+		} else if layout, ok := routes.contentLayouts[trimmedPath]; ok {
+			tplName = layout
+		}
 		if err == nil {
 			defer rows.Close()
 			for rows.Next() {
@@ -213,6 +203,16 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 			}
 		}
 
+		// Routes with a template named after them render it for browsers, unless they opt out with @wtf-json
+		if tplName == "" && !HasDirective(content, "json") {
+			if name, ok := routes.conventionTemplate(trimmedPath); ok {
+				w.Header().Add("Vary", "Accept")
+				if acceptsHTML(r) {
+					tplName = name
+				}
+			}
+		}
+
 		// Handle response cookies
 		rows, err = tx.Query("SELECT name, value, max_age, expires, path, domain, secure, http_only, same_site FROM response_cookies")
 		if err != nil {
@@ -284,6 +284,35 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 			}
 		}
 
+		if err := writeFlash(tx, w, r, app.flashKey, tplName != ""); err != nil {
+			log.Printf("Error writing flash: %v", err)
+		}
+
+		// Template globals are only needed when a template is rendered
+		var globals map[string]any
+		if tplName != "" {
+			var code int
+			if globals, code, err = templateGlobals(app, routes, tx, trans, varsMap); err != nil {
+				writeQueryError(w, r, code, err)
+				return
+			}
+
+			if frontMatter, ok := routes.pages[trimmedPath]; ok {
+				globals["page"] = frontMatter
+			}
+
+			if _, ok := routes.contentLayouts[trimmedPath]; ok {
+				content, err := contentContext(tx, trimmedPath)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				for key, value := range content {
+					globals[key] = value
+				}
+			}
+		}
+
 		if err := tx.Commit(); err != nil {
 			http.Error(w, "Error committing transaction: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -293,32 +322,29 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 			w.Header().Set(name, value)
 		}
 
-		w.WriteHeader(statusCode)
-
 		if tplName != "" {
-			w.Header().Set("Content-Type", "text/html")
+			contextData := buildTemplateContext(app, r, pathParams, globals, results)
 
-			template, ok := app.tpl[tplName]
+			template, ok := routes.tpl[tplName]
 			if !ok {
-				http.Error(w, "Template not found: "+tplName, http.StatusInternalServerError)
+				app.writeTemplateError(w, trimmedPath, tplName, fmt.Errorf("Template not found: %s", tplName), contextData)
 				return
 			}
 
-			// Convert results to the expected type for exec.NewContext
-			contextData := make(map[string]interface{})
-			for key, value := range results {
-				contextData[key] = value
+			// Render into a buffer, so a failing template can still send a proper error page
+			var buf bytes.Buffer
+			err = template.Execute(&buf, exec.NewContext(bindRequestFunctions(contextData, bound)))
+			if err != nil {
+				app.writeTemplateError(w, trimmedPath, tplName, err, contextData)
+				return
 			}
 
-			data := exec.NewContext(contextData)
-
-			if err = template.Execute(w, data); err != nil {
-				http.Error(w, "Error rendering template: "+err.Error(), http.StatusInternalServerError)
-				return
+			if w.Header().Get("Content-Type") == "" {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			}
+			w.WriteHeader(statusCode)
+			w.Write(buf.Bytes())
 		} else {
-			// this should probably depend on the content type set into response meta?
-			w.Header().Set("Content-Type", "application/json")
 
 			// If results only contains ctx, output just that, otherwise output all results
 			var outputData any
@@ -341,15 +367,92 @@ func createHandler(app *App, path string, pathParams []string) http.HandlerFunc
 				}
 			}
 
-			if err := json.NewEncoder(w).Encode(outputData); err != nil {
+			var buf bytes.Buffer
+			if err := json.NewEncoder(&buf).Encode(outputData); err != nil {
 				http.Error(w, "Error encoding JSON: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
+
+			// this should probably depend on the content type set into response meta?
+			if w.Header().Get("Content-Type") == "" {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			w.WriteHeader(statusCode)
+			w.Write(buf.Bytes())
 		}
 
 	}
 }
 
+// executeQueries runs the parsed queries in order, applying their directives.
+// Results without a store directive go into "ctx" only when storeCtx is set,
+// so middleware can't clobber the results of the route itself.
+// On failure, it returns the HTTP status code that should be sent.
+func executeQueries(app *App, tx *sql.Tx, trans ut.Translator, parsedQueries []ParsedQuery, varsMap map[string]any, results map[string][]map[string]any, storeCtx bool) (int, error) {
+	// Typed params are coerced up front, so every query and validation sees the same values
+	if err := applyParamDirectives(parsedQueries, varsMap); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	for _, query := range parsedQueries {
+		if err := validateQuery(app, tx, trans, query.Directives, varsMap); err != nil {
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				return http.StatusBadRequest, err
+			}
+			return http.StatusInternalServerError, err
+		}
+
+		result, err := executeQuery(tx, query.Query, varsMap)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		// Check for store directive
+		storeDirectiveFound := false
+		for _, directive := range query.Directives {
+			if directive.name == "store" && len(directive.params) > 0 {
+				// Store the result under the specified key
+				storeKey := directive.params[0]
+				results[storeKey] = result
+				storeDirectiveFound = true
+				break
+			}
+		}
+
+		// If no store directive was found, store the result in the "ctx" key
+		if !storeDirectiveFound && storeCtx {
+			results["ctx"] = result
+		}
+
+		for _, directive := range query.Directives {
+			if directive.name == "capture" && len(directive.params) > 0 {
+				varName := directive.params[0]
+				isScalar := false
+				if len(directive.params) == 2 && directive.params[1] == "single" {
+					isScalar = true
+				}
+
+				if isScalar && len(result) > 0 {
+					// For scalar, get the first value of the first row
+					for _, val := range result[0] {
+						varsMap[varName] = val
+						break
+					}
+				} else {
+					// Otherwise store the entire result set as JSON
+					jsonData, err := json.Marshal(result)
+					if err == nil {
+						varsMap[varName] = string(jsonData)
+					}
+				}
+			}
+		}
+	}
+
+	return http.StatusOK, nil
+}
+
 func namedParamsToArgs(varsMap map[string]interface{}) []interface{} {
 	args := make([]interface{}, 0, len(varsMap))
 	for name, value := range varsMap {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// expandIncludes splices the contents of every file referenced by a
+// `-- @wtf-include <path>` directive into the SQL blob. Paths are resolved
+// against the webroot, and included files may themselves include other files.
+// The stack holds the chain of files currently being expanded and is used to
+// detect include cycles.
+func expandIncludes(webRoot, content string, stack []string) (string, error) {
+	lines := strings.Split(content, "\n")
+	var expanded []string
+
+	for _, line := range lines {
+		trimmedLine := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmedLine, "--") {
+			expanded = append(expanded, line)
+			continue
+		}
+
+		directive := ParseDirective(trimmedLine)
+		if directive.name != "include" {
+			expanded = append(expanded, line)
+			continue
+		}
+
+		if len(directive.params) == 0 {
+			return "", fmt.Errorf("@wtf-include in %s requires a path", stack[len(stack)-1])
+		}
+
+		target, err := resolveIncludePath(directive.params[0])
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", stack[len(stack)-1], err)
+		}
+
+		if slices.Contains(stack, target) {
+			return "", fmt.Errorf("include cycle detected: %s -> %s", strings.Join(stack, " -> "), target)
+		}
+
+		includedContent, err := os.ReadFile(filepath.Join(webRoot, target))
+		if err != nil {
+			return "", fmt.Errorf("%s: error reading included file %s: %v", stack[len(stack)-1], target, err)
+		}
+
+		includedQueries, err := expandIncludes(webRoot, string(includedContent), append(stack, target))
+		if err != nil {
+			return "", err
+		}
+
+		// Directives written above the include apply to the first included
+		// query, and the trailing terminator keeps the last included query
+		// from merging with the one following the directive
+		expanded = append(expanded, includedQueries, ";")
+	}
+
+	return strings.Join(expanded, "\n"), nil
+}
+
+// resolveIncludePath cleans an include path, relative to the webroot, and rejects
+// paths that leave it
+func resolveIncludePath(includePath string) (string, error) {
+	cleaned := filepath.ToSlash(filepath.Clean(strings.TrimPrefix(includePath, "/")))
+
+	if cleaned == "" || cleaned == "." {
+		return "", fmt.Errorf("invalid include path '%s'", includePath)
+	}
+
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("included file '%s' is outside the webroot", includePath)
+	}
+
+	if filepath.Ext(cleaned) != ".sql" {
+		return "", fmt.Errorf("included file '%s' must be a .sql file", includePath)
+	}
+
+	return cleaned, nil
+}
+
+// isPartialPath reports whether any segment of the path starts with an underscore.
+// Such files can be included by routes, but are never routed directly.
+func isPartialPath(relativePath string) bool {
+	for _, segment := range strings.Split(filepath.ToSlash(relativePath), "/") {
+		if strings.HasPrefix(segment, "_") {
+			return true
+		}
+	}
+	return false
+}
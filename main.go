@@ -4,10 +4,12 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
+	"os"
+	"slices"
 	"time"
 
-	"github.com/go-playground/validator/v10"
 	"github.com/joho/godotenv"
 	"github.com/nikolalohinski/gonja/v2"
 	"github.com/sad-pixel/wtfhttpd/cache"
@@ -30,16 +32,93 @@ func main() {
 	fmt.Println(logo)
 	kvCache := cache.NewKVCache()
 	gonja.DefaultConfig.AutoEscape = true
-	udfs.RegisterUdfs(kvCache)
 
 	config := LoadConfig()
+	markdownRenderer = newMarkdownRenderer(config)
 
-	db, err := sql.Open("sqlite", config.Db)
+	if config.LoadDotenv {
+		log.Println("Loading .env file from webroot/.env")
+		err := godotenv.Load(fmt.Sprintf("%s/.env", config.WebRoot))
+		if err != nil {
+			log.Printf("Warning: Could not load .env file: %v", err)
+		}
+	}
+
+	httpCacheDb := ""
+	if config.HTTPCache {
+		httpCacheDb = config.HTTPCacheDb
+	}
+
+	httpClient, err := udfs.NewHTTPClient(udfs.HTTPConfig{
+		Timeout:         config.HTTPTimeout,
+		MaxBodyBytes:    config.HTTPMaxBodyBytes,
+		FollowRedirects: config.HTTPFollowRedirects,
+		MaxRedirects:    config.HTTPMaxRedirects,
+		AllowHosts:      config.HTTPAllowHosts,
+		DenyHosts:       config.HTTPDenyHosts,
+		BlockPrivate:    config.HTTPBlockPrivate,
+		CacheDB:         httpCacheDb,
+		CassetteDir:     config.HTTPCassetteDir,
+		CassetteMode:    config.HTTPCassette,
+	})
+	if err != nil {
+		log.Fatalf("Error setting up the HTTP client: %v", err)
+	}
+
+	// The secret can also come from the environment, e.g. WTF_SECRET_KEY, to keep it out of wtf.toml
+	secretKey := config.SecretKey
+	if secretKey == "" {
+		secretKey = os.Getenv(config.EnvPrefix + "SECRET_KEY")
+	}
+	crypto, err := udfs.NewCrypto(secretKey)
+	if err != nil {
+		log.Fatalf("Error setting up encryption: %v", err)
+	}
+	flashKey, err := newFlashKey(secretKey)
+	if err != nil {
+		log.Fatalf("Error setting up flash cookies: %v", err)
+	}
+
+	jwtKeys := []udfs.JWTKeyConfig{}
+	for _, id := range slices.Sorted(maps.Keys(config.JWTKeys)) {
+		key := config.JWTKeys[id]
+		jwtKeys = append(jwtKeys, udfs.JWTKeyConfig{
+			ID:             id,
+			Algorithm:      key.Algorithm,
+			Secret:         key.Secret,
+			PrivateKeyFile: key.PrivateKeyFile,
+			PublicKeyFile:  key.PublicKeyFile,
+		})
+	}
+
+	jwt, err := udfs.NewJWT(udfs.JWTConfig{
+		Keys:       jwtKeys,
+		JWKSFile:   config.JWTJWKSFile,
+		DefaultKey: config.JWTDefaultKey,
+		Issuer:     config.JWTIssuer,
+		Audience:   config.JWTAudience,
+		TTL:        config.JWTTTL,
+		Leeway:     config.JWTLeeway,
+	})
 	if err != nil {
-		log.Fatalf("Error opening database: %v", err)
+		log.Fatalf("Error setting up JWT keys: %v", err)
+	}
+
+	if err := udfs.SetTimezone(config.Timezone); err != nil {
+		log.Fatalf("Error setting the timezone: %v", err)
 	}
+
+	udfs.RegisterUdfs(kvCache, httpClient, crypto, jwt, markdownRenderer)
+	registerTemplateFunctions(udfs.Functions(kvCache, httpClient, crypto, jwt, markdownRenderer), config.TemplateFuncs)
+
+	tableFunctions := udfs.TableFunctions(httpClient)
+	db := sql.OpenDB(udfs.NewConnector(config.Db, tableFunctions))
 	defer db.Close()
 
+	if err := udfs.CheckTableFunctions(db, tableFunctions); err != nil {
+		log.Fatal(err)
+	}
+
 	// Create the wtf_routes table to track routes
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS wtf_routes (
@@ -53,26 +132,39 @@ func main() {
 		log.Fatalf("Error creating wtf_routes table: %v", err)
 	}
 
-	if config.LoadDotenv {
-		log.Println("Loading .env file from webroot/.env")
-		err := godotenv.Load(fmt.Sprintf("%s/.env", config.WebRoot))
-		if err != nil {
-			log.Printf("Warning: Could not load .env file: %v", err)
-		}
-	}
+	vd, translator := newValidator()
 
 	app := &App{
 		Config:    config,
 		DB:        db,
 		startedAt: time.Now(),
 		kv:        kvCache,
-		vd:        validator.New(),
+		http:      httpClient,
+		routes:    newRouteTable(),
+		jwt:       jwt,
+		flashKey:  flashKey,
+		vd:        vd,
+		ut:        translator,
 	}
 
 	if err := app.reloadRoutes(); err != nil {
 		return
 	}
 
+	// `wtfhttpd openapi [output_file]` writes the OpenAPI document and exits
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		output := "openapi.json"
+		if len(os.Args) > 2 {
+			output = os.Args[2]
+		}
+
+		if err := app.writeOpenAPISpec(output); err != nil {
+			log.Fatalf("Error writing OpenAPI spec: %v", err)
+		}
+		log.Println("Wrote OpenAPI spec to", output)
+		return
+	}
+
 	if config.LiveReload {
 		log.Println("Starting Live Reloader")
 		go app.liveReloader()
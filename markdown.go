@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	htmlstd "html"
 	"log"
 	"os"
 	"path/filepath"
@@ -11,90 +16,424 @@ import (
 
 	"github.com/gernest/front"
 	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
 )
 
-func (app *App) indexContent() error {
-	log.Println("Indexing content...")
-	startTime := time.Now()
-	fileCount := 0
+// markdownRenderer renders markdown for the content index and the markdown template
+// filter. It's built from the config when the server starts.
+var markdownRenderer = newMarkdownRenderer(NewConfig())
 
-	tx, err := app.DB.Begin()
+// newMarkdownRenderer builds the markdown pipeline, with the extensions enabled in the config
+func newMarkdownRenderer(config *Config) goldmark.Markdown {
+	extensions := []goldmark.Extender{extension.GFM}
+
+	if config.MarkdownFootnotes {
+		extensions = append(extensions, extension.Footnote)
+	}
+	if config.MarkdownTypographer {
+		extensions = append(extensions, extension.Typographer)
+	}
+	if config.MarkdownHighlight {
+		extensions = append(extensions, highlighting.NewHighlighting(
+			highlighting.WithStyle(config.MarkdownHighlightStyle),
+		))
+	}
+
+	return goldmark.New(
+		goldmark.WithExtensions(extensions...),
+		goldmark.WithParserOptions(
+			parser.WithAutoHeadingID(),
+		),
+		goldmark.WithRendererOptions(
+			html.WithHardWraps(),
+			html.WithXHTML(),
+		),
+	)
+}
+
+// tocEntry is a heading in the table of contents of a markdown document
+type tocEntry struct {
+	Level int    `json:"level"`
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
+// renderMarkdown converts markdown to HTML, and lists its headings for a table of contents.
+// Shortcodes are left in the HTML as they were written, to be expanded when it's served.
+func renderMarkdown(source string) (string, []tocEntry, error) {
+	protected, shortcodes := protectShortcodes(source)
+	src := []byte(protected)
+
+	doc := markdownRenderer.Parser().Parse(text.NewReader(src))
+
+	toc := []tocEntry{}
+	err := ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := node.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+
+		entry := tocEntry{Level: heading.Level, Title: nodeText(heading, src)}
+		if id, ok := heading.AttributeString("id"); ok {
+			if b, ok := id.([]byte); ok {
+				entry.ID = string(b)
+			}
+		}
+		toc = append(toc, entry)
+		return ast.WalkSkipChildren, nil
+	})
 	if err != nil {
-		return err
+		return "", nil, err
 	}
-	defer tx.Rollback()
 
-	// Drop existing tables if they exist
-	_, err = tx.Exec(`DROP TABLE IF EXISTS posts_fts`)
+	var buf bytes.Buffer
+	if err := markdownRenderer.Renderer().Render(&buf, src, doc); err != nil {
+		return "", nil, err
+	}
+
+	return restoreShortcodes(buf.String(), shortcodes), toc, nil
+}
+
+// nodeText returns the plain text of a markdown node, leaving out any formatting
+func nodeText(node ast.Node, src []byte) string {
+	var b strings.Builder
+	for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+		switch n := child.(type) {
+		case *ast.Text:
+			b.Write(n.Segment.Value(src))
+			if n.SoftLineBreak() {
+				b.WriteString(" ")
+			}
+		case *ast.String:
+			b.WriteString(htmlstd.UnescapeString(string(n.Value)))
+		default:
+			b.WriteString(nodeText(child, src))
+		}
+	}
+	return b.String()
+}
+
+// parseFrontMatter separates the YAML front matter, delimited by --- lines, from the
+// rest of the content. It also returns the number of lines the front matter took up.
+// Content without front matter is returned as is.
+func parseFrontMatter(content string) (map[string]any, string, int, error) {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return map[string]any{}, content, 0, nil
+	}
+
+	for i := 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "---" {
+			continue
+		}
+
+		frontMatter, err := front.YAMLHandler(strings.Join(lines[1:i], ""))
+		if err != nil {
+			return nil, "", 0, fmt.Errorf("invalid front matter: %v", err)
+		}
+		if frontMatter == nil {
+			frontMatter = map[string]any{}
+		}
+
+		return frontMatter, strings.Join(lines[i+1:], ""), i + 1, nil
+	}
+
+	return nil, "", 0, fmt.Errorf("front matter is missing its closing ---")
+}
+
+// contentSchemaVersion is bumped whenever the content tables change, so the
+// index is rebuilt from scratch instead of being updated in place
+const contentSchemaVersion = "4"
+
+// indexedContent is the state of a content file when it was last indexed
+type indexedContent struct {
+	mtime int64
+	hash  string
+}
+
+// setupContentTables creates the content tables, and the triggers that keep
+// posts_fts and wtf_content_tags in sync with wtf_content
+func setupContentTables(tx *sql.Tx, config *Config) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS wtf_meta (name TEXT PRIMARY KEY, value TEXT NOT NULL)`)
 	if err != nil {
 		return err
 	}
 
-	_, err = tx.Exec(`DROP TABLE IF EXISTS wtf_content`)
-	if err != nil {
+	var version string
+	err = tx.QueryRow(`SELECT value FROM wtf_meta WHERE name = 'content_schema_version'`).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
 		return err
 	}
 
-	_, err = tx.Exec(`
-		CREATE TABLE IF NOT EXISTS wtf_content (
+	if version != contentSchemaVersion {
+		log.Println("Content tables are outdated, rebuilding the content index")
+		for _, statement := range []string{
+			`DROP TABLE IF EXISTS posts_fts`,
+			`DROP VIEW IF EXISTS wtf_content_search`,
+			`DROP VIEW IF EXISTS wtf_content_nav`,
+			`DROP TABLE IF EXISTS wtf_content_tags`,
+			`DROP TABLE IF EXISTS wtf_content`,
+		} {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(`INSERT OR REPLACE INTO wtf_meta (name, value) VALUES ('content_schema_version', ?)`, contentSchemaVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS wtf_content (
 			id INTEGER PRIMARY KEY,
 			title TEXT NOT NULL,
 			path TEXT UNIQUE NOT NULL,
-			slug TEXT UNIQUE NOT NULL,
+			slug TEXT NOT NULL,
+			collection TEXT NOT NULL DEFAULT '',
+			permalink TEXT UNIQUE NOT NULL,
+			layout TEXT DEFAULT '',
+			date TEXT NOT NULL,
+			tags TEXT DEFAULT '[]',
 			metadata TEXT DEFAULT '{}',
 			raw_body TEXT DEFAULT '',
-			html_body TEXT DEFAULT ''
-		)`)
-	if err != nil {
-		return err
-	}
-
-	_, err = tx.Exec(`
-		CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
+			html_body TEXT DEFAULT '',
+			toc TEXT DEFAULT '[]',
+			search_tags TEXT DEFAULT '',
+			search_fields TEXT DEFAULT '',
+			mtime INTEGER NOT NULL DEFAULT 0,
+			hash TEXT NOT NULL DEFAULT '',
+			UNIQUE (collection, slug)
+		)`,
+		`CREATE TABLE IF NOT EXISTS wtf_content_tags (
+			content_id INTEGER NOT NULL REFERENCES wtf_content(id) ON DELETE CASCADE,
+			tag TEXT NOT NULL,
+			PRIMARY KEY (content_id, tag)
+		)`,
+		// Content in the same collection is chained by date, from the oldest to the newest
+		`CREATE VIEW IF NOT EXISTS wtf_content_nav AS
+		SELECT
+			id,
+			LAG(id) OVER collection_by_date AS prev_id,
+			LEAD(id) OVER collection_by_date AS next_id
+		FROM wtf_content
+		WINDOW collection_by_date AS (PARTITION BY collection ORDER BY date, path)`,
+		// The rowid of posts_fts is the id of the content it was created from
+		`CREATE VIRTUAL TABLE IF NOT EXISTS posts_fts USING fts5(
 			title,
 			content,
+			tags,
+			fields,
 			tokenize = 'porter unicode61'
-		)`)
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS wtf_content_fts_insert AFTER INSERT ON wtf_content BEGIN
+			INSERT INTO posts_fts (rowid, title, content, tags, fields)
+			VALUES (new.id, new.title, new.raw_body, new.search_tags, new.search_fields);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS wtf_content_fts_update AFTER UPDATE OF title, raw_body, search_tags, search_fields ON wtf_content BEGIN
+			DELETE FROM posts_fts WHERE rowid = old.id;
+			INSERT INTO posts_fts (rowid, title, content, tags, fields)
+			VALUES (new.id, new.title, new.raw_body, new.search_tags, new.search_fields);
+		END`,
+		// Foreign keys aren't enforced by default, so tags are removed here too
+		`CREATE TRIGGER IF NOT EXISTS wtf_content_delete AFTER DELETE ON wtf_content BEGIN
+			DELETE FROM posts_fts WHERE rowid = old.id;
+			DELETE FROM wtf_content_tags WHERE content_id = old.id;
+		END`,
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	// Changing what's indexed for search, or how markdown is rendered, reindexes every file
+	var indexSettings string
+	err = tx.QueryRow(`SELECT value FROM wtf_meta WHERE name = 'content_index_settings'`).Scan(&indexSettings)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	current := fmt.Sprint(
+		config.ContentSearchTags, config.ContentSearchFields,
+		config.MarkdownHighlight, config.MarkdownHighlightStyle, config.MarkdownFootnotes, config.MarkdownTypographer,
+	)
+	if indexSettings != current {
+		if _, err := tx.Exec(`UPDATE wtf_content SET mtime = 0, hash = ''`); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR REPLACE INTO wtf_meta (name, value) VALUES ('content_index_settings', ?)`, current)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The search view is recreated every time, since the weights come from the config
+	weights := config.ContentSearchWeights
+	_, err = tx.Exec(`DROP VIEW IF EXISTS wtf_content_search`)
 	if err != nil {
 		return err
 	}
 
-	// Prepare statements for inserting into wtf_content and posts_fts tables
+	_, err = tx.Exec(fmt.Sprintf(`
+		CREATE VIEW wtf_content_search AS
+		SELECT
+			c.id, c.title, c.path, c.slug, c.collection, c.permalink, c.layout, c.date, c.tags, c.metadata,
+			posts_fts AS query,
+			bm25(posts_fts, %g, %g, %g, %g) AS rank,
+			highlight(posts_fts, 0, '<mark>', '</mark>') AS title_highlight,
+			snippet(posts_fts, 1, '<mark>', '</mark>', '…', 32) AS snippet
+		FROM posts_fts
+		JOIN wtf_content c ON c.id = posts_fts.rowid`,
+		weights["title"], weights["content"], weights["tags"], weights["fields"]))
+	return err
+}
+
+// contentSearchText returns the tags and extra front matter fields of a content
+// file to add to the search index, according to the config
+func contentSearchText(config *Config, frontMatter map[string]any, tags []string) (string, string) {
+	searchTags := ""
+	if config.ContentSearchTags {
+		searchTags = strings.Join(tags, " ")
+	}
+
+	var fields []string
+	for _, field := range config.ContentSearchFields {
+		switch value := frontMatter[field].(type) {
+		case nil:
+		case []any:
+			for _, item := range value {
+				fields = append(fields, fmt.Sprint(item))
+			}
+		default:
+			fields = append(fields, fmt.Sprint(value))
+		}
+	}
+
+	return searchTags, strings.Join(fields, " ")
+}
+
+// reindexContent updates the content index in the background, so large content
+// trees don't hold up route reloads. If content routes are enabled and any content
+// changed, the routes are loaded again once indexing is done.
+func (app *App) reindexContent() {
+	go func() {
+		changed, err := app.indexContent()
+		if err != nil {
+			log.Printf("Error indexing content: %v", err)
+			return
+		}
+
+		// The index is already up to date, so only the routes are loaded again
+		if changed && app.Config.ContentRoutes {
+			if err := app.loadRoutes(); err != nil {
+				log.Printf("Error applying reloaded routes: %v", err)
+			}
+		}
+	}()
+}
+
+// indexContent brings the content index up to date with the markdown files in the
+// content directory. Files whose modification time and hash haven't changed are
+// skipped, and files that no longer exist are removed.
+// It reports whether any content was added, updated or removed.
+func (app *App) indexContent() (bool, error) {
+	app.indexMu.Lock()
+	defer app.indexMu.Unlock()
+
+	log.Println("Indexing content...")
+	startTime := time.Now()
+	fileCount, unchangedCount, removedCount := 0, 0, 0
+
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := setupContentTables(tx, app.Config); err != nil {
+		return false, err
+	}
+
+	existing := make(map[string]indexedContent)
+	rows, err := tx.Query(`SELECT path, mtime, hash FROM wtf_content`)
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var path string
+		var indexed indexedContent
+		if err := rows.Scan(&path, &indexed.mtime, &indexed.hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		existing[path] = indexed
+	}
+	rows.Close()
+
+	// Prepare statements for updating wtf_content, whose triggers keep posts_fts in sync
 	stmtContent, err := tx.Prepare(`
-		INSERT INTO wtf_content (title, path, slug, metadata, raw_body, html_body)
-		VALUES (?, ?, ?, ?, ?, ?)
+		INSERT INTO wtf_content (title, path, slug, collection, permalink, layout, date, tags, metadata, raw_body, html_body, toc, search_tags, search_fields, mtime, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(path) DO UPDATE SET
 			title = excluded.title,
 			slug = excluded.slug,
+			collection = excluded.collection,
+			permalink = excluded.permalink,
+			layout = excluded.layout,
+			date = excluded.date,
+			tags = excluded.tags,
 			metadata = excluded.metadata,
 			raw_body = excluded.raw_body,
-			html_body = excluded.html_body
+			html_body = excluded.html_body,
+			toc = excluded.toc,
+			search_tags = excluded.search_tags,
+			search_fields = excluded.search_fields,
+			mtime = excluded.mtime,
+			hash = excluded.hash
+		RETURNING id
 	`)
 	if err != nil {
 		log.Printf("Error preparing content insert statement: %v", err)
-		return err
+		return false, err
 	}
 	defer stmtContent.Close()
 
-	stmtFTS, err := tx.Prepare(`
-		INSERT INTO posts_fts (title, content)
+	stmtClearTags, err := tx.Prepare(`DELETE FROM wtf_content_tags WHERE content_id = ?`)
+	if err != nil {
+		log.Printf("Error preparing content tag delete statement: %v", err)
+		return false, err
+	}
+	defer stmtClearTags.Close()
+
+	stmtTag, err := tx.Prepare(`
+		INSERT OR IGNORE INTO wtf_content_tags (content_id, tag)
 		VALUES (?, ?)
 	`)
 	if err != nil {
-		log.Printf("Error preparing FTS insert statement: %v", err)
-		return err
+		log.Printf("Error preparing content tag insert statement: %v", err)
+		return false, err
 	}
-	defer stmtFTS.Close()
+	defer stmtTag.Close()
+
+	seen := make(map[string]bool)
+	contentDir := filepath.Join(app.Config.WebRoot, "content")
 
-	m := front.NewMatter()
-	m.Handle("---", front.YAMLHandler)
 	walkErr := filepath.Walk(
-		filepath.Join(app.Config.WebRoot, "content"),
+		contentDir,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
+				// A missing content directory just means there's no content
+				if path == contentDir && os.IsNotExist(err) {
+					return filepath.SkipDir
+				}
 				return err
 			}
 
@@ -103,89 +442,142 @@ func (app *App) indexContent() error {
 			}
 
 			fileName := filepath.Base(path)
-			relativePath := strings.TrimPrefix(path, filepath.Join(app.Config.WebRoot, "content")+"/")
+			relativePath := strings.TrimPrefix(path, contentDir+"/")
 			ext := filepath.Ext(path)
 
-			if ext == ".md" || ext == ".markdown" {
-				log.Println("Found markdown file: ", relativePath, fileName)
-				fileHandle, err := os.Open(path)
-				if err != nil {
-					log.Println("Error opening file: ", err)
-					return err
-				}
-				defer fileHandle.Close()
+			if ext != ".md" && ext != ".markdown" {
+				return nil
+			}
 
-				frontMatter, body, err := m.Parse(fileHandle)
-				if err != nil {
-					log.Printf("Error parsing markdown file %s: %v", relativePath, err)
-					return nil
-				}
+			// Files that fail to index keep their previous version
+			seen[relativePath] = true
+			mtime := info.ModTime().UnixNano()
 
-				// Convert front matter to JSON for storage
-				metadataJSON, err := json.Marshal(frontMatter)
-				if err != nil {
-					log.Printf("Error marshaling metadata for %s: %v", relativePath, err)
-					return nil
-				}
+			previous, indexed := existing[relativePath]
+			if indexed && previous.mtime == mtime {
+				unchangedCount++
+				return nil
+			}
 
-				// Generate slug from filename
-				slug := strings.TrimSuffix(fileName, ext)
+			content, err := os.ReadFile(path)
+			if err != nil {
+				log.Printf("Error reading %s: %v", relativePath, err)
+				return nil
+			}
 
-				// Get title from front matter or use filename
-				title := fileName
-				if t, ok := frontMatter["title"].(string); ok {
-					title = t
+			sum := sha256.Sum256(content)
+			hash := hex.EncodeToString(sum[:])
+			if indexed && previous.hash == hash {
+				// Touched, but not changed
+				if _, err := tx.Exec(`UPDATE wtf_content SET mtime = ? WHERE path = ?`, mtime, relativePath); err != nil {
+					log.Printf("Error updating modification time of %s: %v", relativePath, err)
 				}
+				unchangedCount++
+				return nil
+			}
 
-				// Render markdown to HTML using goldmark
-				var buf bytes.Buffer
-				markdown := goldmark.New(
-					goldmark.WithExtensions(extension.GFM),
-					goldmark.WithParserOptions(
-						parser.WithAutoHeadingID(),
-					),
-					goldmark.WithRendererOptions(
-						html.WithHardWraps(),
-						html.WithXHTML(),
-					),
-				)
-				if err := markdown.Convert([]byte(body), &buf); err != nil {
-					log.Printf("Error rendering markdown for %s: %v", relativePath, err)
-					return nil
-				}
-				renderedHTML := buf.String()
+			log.Println("Found markdown file: ", relativePath, fileName)
+			frontMatter, body, _, err := parseFrontMatter(string(content))
+			if err != nil {
+				log.Printf("Error parsing markdown file %s: %v", relativePath, err)
+				return nil
+			}
 
-				// Insert into content table
-				_, err = stmtContent.Exec(title, relativePath, slug, string(metadataJSON), body, renderedHTML)
-				if err != nil {
-					log.Printf("Error inserting content for %s: %v", relativePath, err)
-					return nil
-				}
+			// Convert front matter to JSON for storage
+			metadataJSON, err := json.Marshal(frontMatter)
+			if err != nil {
+				log.Printf("Error marshaling metadata for %s: %v", relativePath, err)
+				return nil
+			}
 
-				// Insert into FTS table
-				_, err = stmtFTS.Exec(title, body)
-				if err != nil {
-					log.Printf("Error inserting into FTS for %s: %v", relativePath, err)
-					return nil
-				}
+			// Generate slug from filename, unless the front matter sets one
+			slug := strings.TrimSuffix(fileName, ext)
+			if s, ok := frontMatter["slug"].(string); ok && s != "" {
+				slug = s
+			}
 
-				log.Printf("Inserted %s into database", relativePath)
-				fileCount++
+			// Get title from front matter or use filename
+			title := fileName
+			if t, ok := frontMatter["title"].(string); ok {
+				title = t
 			}
+
+			layout, _ := frontMatter["layout"].(string)
+			tags := parseContentTags(frontMatter["tags"])
+			tagsJSON, _ := json.Marshal(tags)
+			searchTags, searchFields := contentSearchText(app.Config, frontMatter, tags)
+
+			renderedHTML, toc, err := renderMarkdown(body)
+			if err != nil {
+				log.Printf("Error rendering markdown for %s: %v", relativePath, err)
+				return nil
+			}
+			tocJSON, _ := json.Marshal(toc)
+
+			// Insert into content table
+			var id int64
+			err = stmtContent.QueryRow(
+				title,
+				relativePath,
+				slug,
+				contentCollection(relativePath),
+				contentPermalink(frontMatter, relativePath, slug),
+				layout,
+				contentDate(frontMatter, info.ModTime()),
+				string(tagsJSON),
+				string(metadataJSON),
+				body,
+				renderedHTML,
+				string(tocJSON),
+				searchTags,
+				searchFields,
+				mtime,
+				hash,
+			).Scan(&id)
+			if err != nil {
+				log.Printf("Error inserting content for %s: %v", relativePath, err)
+				return nil
+			}
+
+			if _, err := stmtClearTags.Exec(id); err != nil {
+				log.Printf("Error clearing tags for %s: %v", relativePath, err)
+			}
+			for _, tag := range tags {
+				if _, err := stmtTag.Exec(id, tag); err != nil {
+					log.Printf("Error inserting tag %s for %s: %v", tag, relativePath, err)
+				}
+			}
+
+			log.Printf("Inserted %s into database", relativePath)
+			fileCount++
 			return nil
 		})
 
 	if walkErr != nil {
 		log.Println("Error walking: ", walkErr)
-		return walkErr
+		return false, walkErr
+	}
+
+	for path := range existing {
+		if seen[path] {
+			continue
+		}
+
+		if _, err := tx.Exec(`DELETE FROM wtf_content WHERE path = ?`, path); err != nil {
+			log.Printf("Error removing deleted content %s: %v", path, err)
+			continue
+		}
+		log.Printf("Removed %s from database", path)
+		removedCount++
 	}
+
 	if err := tx.Commit(); err != nil {
 		log.Println("Error committing transaction:", err)
-		return err
+		return false, err
 	}
 
 	elapsed := time.Since(startTime)
-	log.Printf("Content indexing complete: %d files indexed in %v", fileCount, elapsed)
+	log.Printf("Content indexing complete: %d files indexed, %d unchanged, %d removed in %v", fileCount, unchangedCount, removedCount, elapsed)
 
-	return nil
+	return fileCount > 0 || removedCount > 0, nil
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// routeMiddleware holds the cache keys of the middleware scripts that wrap a route
+type routeMiddleware struct {
+	before []string
+	after  []string
+}
+
+// loadMiddleware collects the _before.sql and _after.sql scripts that apply to a route.
+// Before scripts run from the webroot down to the route's directory, and after
+// scripts run in the reverse order, from the route's directory up to the webroot.
+func loadMiddleware(app *App, routes *routeTable, relativePath string) (routeMiddleware, error) {
+	var middleware routeMiddleware
+
+	dir := strings.Trim(filepath.ToSlash(filepath.Dir(relativePath)), "/")
+	dirs := []string{""}
+	if dir != "" && dir != "." {
+		current := ""
+		for _, segment := range strings.Split(dir, "/") {
+			current = filepath.Join(current, segment)
+			dirs = append(dirs, current)
+		}
+	}
+
+	for _, d := range dirs {
+		before, err := loadMiddlewareFile(app, routes, filepath.Join(d, "_before.sql"))
+		if err != nil {
+			return middleware, err
+		}
+		if before != "" {
+			middleware.before = append(middleware.before, before)
+		}
+
+		after, err := loadMiddlewareFile(app, routes, filepath.Join(d, "_after.sql"))
+		if err != nil {
+			return middleware, err
+		}
+		if after != "" {
+			middleware.after = append([]string{after}, middleware.after...)
+		}
+	}
+
+	return middleware, nil
+}
+
+// loadMiddlewareFile reads a middleware script into the sqlCache, and returns its cache key.
+// An empty key is returned if the script doesn't exist.
+func loadMiddlewareFile(app *App, routes *routeTable, cacheKey string) (string, error) {
+	if _, ok := routes.sqlCache[cacheKey]; ok {
+		return cacheKey, nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(app.Config.WebRoot, cacheKey))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("error reading middleware %s: %v", cacheKey, err)
+	}
+
+	expanded, err := expandIncludes(app.Config.WebRoot, string(content), []string{cacheKey})
+	if err != nil {
+		return "", err
+	}
+	if err := checkParamDirectives(expanded); err != nil {
+		return "", fmt.Errorf("%s: %v", cacheKey, err)
+	}
+
+	routes.sqlCache[cacheKey] = expanded
+	log.Println("Loaded middleware ", cacheKey)
+	return cacheKey, nil
+}
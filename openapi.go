@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikolalohinski/gonja/v2"
+	"github.com/nikolalohinski/gonja/v2/exec"
+)
+
+var operationIdRegex = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// apiField describes a single input of a route, gathered from its directives
+type apiField struct {
+	name       string
+	in         string // path, query, form or json
+	paramType  string
+	defaultVal string
+	rules      []string
+	required   bool
+}
+
+// apiOperation describes a route as an OpenAPI operation
+type apiOperation struct {
+	method      string
+	path        string
+	file        string
+	summary     string
+	description string
+	fields      []*apiField
+	validated   bool
+}
+
+// collectAPIOperations builds the operations for every registered route from
+// wtf_routes, the path params and the directives of the route and its middleware
+func (app *App) collectAPIOperations() ([]apiOperation, error) {
+	rows, err := app.DB.Query("SELECT method, path, file FROM wtf_routes ORDER BY path, method")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var operations []apiOperation
+	for rows.Next() {
+		var method, path, file string
+		if err := rows.Scan(&method, &path, &file); err != nil {
+			log.Printf("Error scanning route row: %v", err)
+			continue
+		}
+
+		path = strings.TrimSuffix(path, "{$}")
+		cacheKey := strings.TrimPrefix(file, "/")
+
+		methods := []string{method}
+		if method == "ANY" {
+			methods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+		}
+
+		for _, m := range methods {
+			operations = append(operations, app.describeOperation(m, path, cacheKey))
+		}
+	}
+
+	return operations, rows.Err()
+}
+
+// describeOperation gathers the documentation and inputs of a single route
+func (app *App) describeOperation(method, path, cacheKey string) apiOperation {
+	operation := apiOperation{
+		method: method,
+		path:   path,
+		file:   cacheKey,
+	}
+
+	bodyIn := "query"
+	if method == "POST" || method == "PUT" || method == "PATCH" {
+		bodyIn = "form"
+	}
+
+	fields := make(map[string]*apiField)
+	field := func(name string) *apiField {
+		if f, ok := fields[name]; ok {
+			return f
+		}
+		f := &apiField{name: name, in: bodyIn}
+		if strings.HasPrefix(name, "$") {
+			f.in = "json"
+		}
+		fields[name] = f
+		operation.fields = append(operation.fields, f)
+		return f
+	}
+
+	for _, param := range extractPathParams(path) {
+		f := field(param)
+		f.in = "path"
+		f.required = true
+	}
+
+	routes := app.currentRoutes()
+
+	var docs []string
+	files := append(append([]string{}, routes.middleware[cacheKey].before...), cacheKey)
+	for _, file := range files {
+		for _, query := range ParseQueries(routes.sqlCache[file]) {
+			for _, directive := range query.Directives {
+				switch {
+				case directive.name == "doc" && file == cacheKey:
+					docs = append(docs, strings.Join(directive.params, " "))
+				case directive.name == "param" && len(directive.params) >= 2:
+					f := field(directive.params[0])
+					f.paramType = strings.ToLower(directive.params[1])
+					if len(directive.params) >= 3 {
+						f.defaultVal = directive.params[2]
+					}
+				case directive.name == "validate" && len(directive.params) >= 2:
+					f := field(directive.params[0])
+					f.rules = append(f.rules, strings.Split(directive.params[1], ",")...)
+					operation.validated = true
+				}
+			}
+		}
+	}
+
+	for _, f := range operation.fields {
+		for _, rule := range f.rules {
+			if rule == "required" {
+				f.required = true
+			}
+		}
+	}
+
+	if len(docs) > 0 {
+		operation.summary = docs[0]
+		operation.description = strings.Join(docs[1:], "\n")
+	}
+
+	return operation
+}
+
+// schema converts the field's declared type and validation rules to a JSON schema
+func (f *apiField) schema() map[string]any {
+	schema := map[string]any{"type": "string"}
+	numeric := false
+
+	switch f.paramType {
+	case "int", "integer":
+		schema["type"] = "integer"
+		numeric = true
+	case "float", "number":
+		schema["type"] = "number"
+		numeric = true
+	case "bool", "boolean":
+		schema["type"] = "boolean"
+	case "json":
+		schema["contentMediaType"] = "application/json"
+	case "date":
+		schema["format"] = "date"
+	case "datetime":
+		schema["format"] = "date-time"
+	}
+
+	if f.defaultVal != "" {
+		if value, err := coerceParam(f.defaultVal, f.paramType); err == nil && f.paramType != "datetime" {
+			schema["default"] = value
+		} else {
+			schema["default"] = f.defaultVal
+		}
+	}
+
+	var notes []string
+	for _, rule := range f.rules {
+		name, arg, _ := strings.Cut(rule, "=")
+		number, numErr := strconv.ParseFloat(arg, 64)
+
+		switch name {
+		case "email":
+			schema["format"] = "email"
+		case "url", "uri", "http_url":
+			schema["format"] = "uri"
+		case "uuid", "uuid4":
+			schema["format"] = "uuid"
+		case "numeric", "number":
+			if f.paramType == "" {
+				schema["pattern"] = `^-?[0-9]+(\.[0-9]+)?$`
+			}
+		case "alpha":
+			schema["pattern"] = "^[a-zA-Z]+$"
+		case "alphanum":
+			schema["pattern"] = "^[a-zA-Z0-9]+$"
+		case "min", "max", "len":
+			if numErr != nil {
+				continue
+			}
+			if numeric {
+				if name != "max" {
+					schema["minimum"] = number
+				}
+				if name != "min" {
+					schema["maximum"] = number
+				}
+			} else {
+				if name != "max" {
+					schema["minLength"] = int(number)
+				}
+				if name != "min" {
+					schema["maxLength"] = int(number)
+				}
+			}
+		case "gte", "lte", "gt", "lt":
+			// Comparisons only make sense for numbers, even when the type wasn't declared
+			if numErr == nil && f.paramType == "" {
+				schema["type"] = "number"
+			}
+		}
+
+		switch name {
+		case "gte":
+			if numErr == nil {
+				schema["minimum"] = number
+			}
+		case "lte":
+			if numErr == nil {
+				schema["maximum"] = number
+			}
+		case "gt":
+			if numErr == nil {
+				schema["exclusiveMinimum"] = number
+			}
+		case "lt":
+			if numErr == nil {
+				schema["exclusiveMaximum"] = number
+			}
+		case "unique":
+			notes = append(notes, fmt.Sprintf("Must not already exist in %s.", arg))
+		case "exists":
+			notes = append(notes, fmt.Sprintf("Must exist in %s.", arg))
+		}
+	}
+
+	if len(notes) > 0 {
+		schema["description"] = strings.Join(notes, " ")
+	}
+
+	return schema
+}
+
+// operationId creates a stable identifier for the operation from its method and file
+func (operation apiOperation) operationId() string {
+	file := strings.TrimSuffix(operation.file, ".sql")
+	file = strings.TrimSuffix(file, "."+strings.ToLower(operation.method))
+	id := strings.Trim(operationIdRegex.ReplaceAllString(file, "_"), "_")
+	return strings.ToLower(operation.method) + "_" + id
+}
+
+// buildOpenAPISpec generates an OpenAPI 3.1 document for the registered routes
+func (app *App) buildOpenAPISpec() (map[string]any, error) {
+	operations, err := app.collectAPIOperations()
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make(map[string]any)
+	for _, operation := range operations {
+		pathItem, ok := paths[operation.path].(map[string]any)
+		if !ok {
+			pathItem = make(map[string]any)
+			paths[operation.path] = pathItem
+		}
+
+		op := map[string]any{
+			"operationId": operation.operationId(),
+			"responses": map[string]any{
+				"200": map[string]any{
+					"description": "Successful response",
+					"content": map[string]any{
+						"application/json": map[string]any{"schema": map[string]any{}},
+						"text/html":        map[string]any{"schema": map[string]any{"type": "string"}},
+					},
+				},
+			},
+		}
+
+		if tag := strings.Split(strings.Trim(operation.path, "/"), "/")[0]; tag != "" && !strings.HasPrefix(tag, "{") {
+			op["tags"] = []string{tag}
+		}
+
+		if operation.summary != "" {
+			op["summary"] = operation.summary
+		}
+		if operation.description != "" {
+			op["description"] = operation.description
+		}
+
+		if operation.validated {
+			op["responses"].(map[string]any)["400"] = map[string]any{
+				"description": "Validation failed",
+				"content": map[string]any{
+					"application/json": map[string]any{
+						"schema": map[string]any{"$ref": "#/components/schemas/ValidationError"},
+					},
+				},
+			}
+		}
+
+		var parameters []map[string]any
+		formSchema := map[string]any{"type": "object", "properties": map[string]any{}}
+		jsonSchema := map[string]any{"type": "object", "properties": map[string]any{}}
+
+		for _, f := range operation.fields {
+			switch f.in {
+			case "path", "query":
+				parameters = append(parameters, map[string]any{
+					"name":     f.name,
+					"in":       f.in,
+					"required": f.required,
+					"schema":   f.schema(),
+				})
+			case "form":
+				addSchemaProperty(formSchema, []string{f.name}, f.schema(), f.required)
+			case "json":
+				segments := strings.Split(strings.TrimPrefix(strings.TrimPrefix(f.name, "$"), "."), ".")
+				if len(segments) > 0 && segments[0] != "" {
+					addSchemaProperty(jsonSchema, segments, f.schema(), f.required)
+				}
+			}
+		}
+
+		if len(parameters) > 0 {
+			op["parameters"] = parameters
+		}
+
+		content := make(map[string]any)
+		if len(formSchema["properties"].(map[string]any)) > 0 {
+			content["application/x-www-form-urlencoded"] = map[string]any{"schema": formSchema}
+			content["multipart/form-data"] = map[string]any{"schema": formSchema}
+		}
+		if len(jsonSchema["properties"].(map[string]any)) > 0 {
+			content["application/json"] = map[string]any{"schema": jsonSchema}
+		}
+		if len(content) > 0 {
+			op["requestBody"] = map[string]any{"content": content}
+		}
+
+		pathItem[strings.ToLower(operation.method)] = op
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "wtfhttpd",
+			"version": "0.0.1",
+		},
+		"servers": []map[string]any{
+			{"url": fmt.Sprintf("http://%s:%d", app.Config.Host, app.Config.Port)},
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": map[string]any{
+				"ValidationError": map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"error": map[string]any{"type": "string"},
+						"fields": map[string]any{
+							"type":                 "object",
+							"additionalProperties": map[string]any{"type": "string"},
+						},
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// addSchemaProperty adds a property to an object schema, creating nested objects
+// for every segment of the path
+func addSchemaProperty(schema map[string]any, segments []string, property map[string]any, required bool) {
+	properties := schema["properties"].(map[string]any)
+	name := segments[0]
+
+	if len(segments) == 1 {
+		properties[name] = property
+		if required {
+			requiredList, _ := schema["required"].([]string)
+			schema["required"] = append(requiredList, name)
+		}
+		return
+	}
+
+	child, ok := properties[name].(map[string]any)
+	if !ok || child["properties"] == nil {
+		child = map[string]any{"type": "object", "properties": map[string]any{}}
+		properties[name] = child
+	}
+	addSchemaProperty(child, segments[1:], property, required)
+}
+
+// serveOpenAPI serves the generated OpenAPI document as JSON
+func (app *App) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if !app.authorizeAdmin(w, r) {
+		return
+	}
+
+	spec, err := app.buildOpenAPISpec()
+	if err != nil {
+		log.Printf("Error building OpenAPI spec: %v", err)
+		http.Error(w, "Error building OpenAPI spec: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(spec)
+}
+
+// serveOpenAPIViewer renders the routes' documentation in the admin interface
+func (app *App) serveOpenAPIViewer(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+
+	tpl, err := gonja.FromFile("./templates/openapi.html")
+	if err != nil {
+		log.Printf("Error loading OpenAPI template: %v", err)
+		http.Error(w, "Error loading template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	operations, err := app.collectAPIOperations()
+	if err != nil {
+		log.Printf("Error collecting API operations: %v", err)
+		http.Error(w, "Error collecting API operations: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var operationsList []map[string]any
+	for _, operation := range operations {
+		var fields []map[string]any
+		for _, f := range operation.fields {
+			schema, _ := json.Marshal(f.schema())
+			fields = append(fields, map[string]any{
+				"name":     f.name,
+				"location": f.in,
+				"required": f.required,
+				"schema":   string(schema),
+			})
+		}
+
+		operationsList = append(operationsList, map[string]any{
+			"method":      operation.method,
+			"path":        operation.path,
+			"file":        operation.file,
+			"summary":     operation.summary,
+			"description": operation.description,
+			"fields":      fields,
+		})
+	}
+
+	renderTime := time.Since(startTime).Milliseconds()
+
+	tplData := exec.NewContext(map[string]any{
+		"operations": operationsList,
+		"render_ms":  renderTime,
+	})
+
+	err = tpl.Execute(w, tplData)
+	if err != nil {
+		log.Printf("Error executing OpenAPI template: %v", err)
+		http.Error(w, "Error executing template: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// writeOpenAPISpec writes the OpenAPI document to a file, for the `wtfhttpd openapi` command
+func (app *App) writeOpenAPISpec(output string) error {
+	spec, err := app.buildOpenAPISpec()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(output, append(data, '\n'), 0644)
+}
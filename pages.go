@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pageExt is the extension of templates that are routed directly, without a SQL file
+const pageExt = ".page.html"
+
+// isPagePath reports whether the file is a routable page template
+func isPagePath(relativePath string) bool {
+	return strings.HasSuffix(filepath.Base(relativePath), pageExt)
+}
+
+// splitFrontMatter separates the YAML front matter of a page from its template.
+// The front matter is replaced with a comment spanning the same lines, so line
+// numbers in template errors still match the file.
+func splitFrontMatter(content string) (map[string]any, string, error) {
+	frontMatter, body, lines, err := parseFrontMatter(content)
+	if err != nil || lines == 0 {
+		return frontMatter, body, err
+	}
+
+	return frontMatter, "{#" + strings.Repeat("\n", lines) + "#}" + body, nil
+}
+
+// pageQueries builds the SQL that populates a page's context from its front matter.
+// The `sql` key names a SQL file in the webroot, and `queries` holds inline queries
+// that run after it.
+func pageQueries(frontMatter map[string]any) (string, error) {
+	var content []string
+
+	if value, ok := frontMatter["sql"]; ok {
+		file, ok := value.(string)
+		if !ok || file == "" {
+			return "", fmt.Errorf("front matter key 'sql' must be a file path")
+		}
+		content = append(content, "-- @wtf-include "+file)
+	}
+
+	if value, ok := frontMatter["queries"]; ok {
+		queries, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("front matter key 'queries' must be a string")
+		}
+		content = append(content, queries)
+	}
+
+	return strings.Join(content, "\n"), nil
+}
+
+// processPage loads a page template and serves it on GET requests, the same way
+// a `.get.sql` file with the same name would be routed
+func processPage(app *App, routes *routeTable, relativePath string, mux *http.ServeMux) error {
+	cacheKey := strings.TrimPrefix(relativePath, "/")
+
+	if isPartialPath(relativePath) {
+		log.Println("Discovered partial: ", cacheKey)
+		return nil
+	}
+
+	content, err := os.ReadFile(filepath.Join(app.Config.WebRoot, cacheKey))
+	if err != nil {
+		log.Printf("Error reading page %s: %v", cacheKey, err)
+		return nil
+	}
+
+	frontMatter, _, err := splitFrontMatter(string(content))
+	if err != nil {
+		log.Printf("Error loading page %s: %v", cacheKey, err)
+		return nil
+	}
+
+	queries, err := pageQueries(frontMatter)
+	if err != nil {
+		log.Printf("Error loading page %s: %v", cacheKey, err)
+		return nil
+	}
+
+	expanded, err := expandIncludes(app.Config.WebRoot, queries, []string{cacheKey})
+	if err != nil {
+		log.Printf("Error expanding queries of page %s: %v", cacheKey, err)
+		return nil
+	}
+	if err := checkParamDirectives(expanded); err != nil {
+		log.Printf("Error in page %s: %v", cacheKey, err)
+		return nil
+	}
+
+	template, deps, err := app.loadTemplate(cacheKey)
+	if err != nil {
+		log.Printf("Error loading page %s: %v", cacheKey, err)
+		return nil
+	}
+
+	middleware, err := loadMiddleware(app, routes, cacheKey)
+	if err != nil {
+		log.Printf("Error loading middleware for %s: %v", cacheKey, err)
+		return nil
+	}
+
+	dir := filepath.Dir(relativePath)
+	if fileName := strings.TrimSuffix(filepath.Base(relativePath), pageExt); fileName != "index" {
+		dir = filepath.Join(dir, fileName)
+	}
+
+	// A page can clash with a route of the same path, which is logged instead of panicking
+	routePath := strings.TrimSuffix(dir, "/") + "/{$}"
+	if err := handleGetRoute(mux, routePath, createHandler(app, relativePath, extractPathParams(dir))); err != nil {
+		log.Printf("Error registering page %s: %v", cacheKey, err)
+		return nil
+	}
+
+	routes.tpl[cacheKey] = template
+	routes.tplDeps[cacheKey] = deps
+	routes.sqlCache[cacheKey] = expanded
+	routes.pages[cacheKey] = frontMatter
+	routes.middleware[cacheKey] = middleware
+
+	fmt.Printf("GET %s -> %s\n", dir, relativePath)
+	_, err = app.DB.Exec("INSERT INTO wtf_routes (path, method, file) VALUES (?, ?, ?)",
+		routePath, "GET", relativePath)
+	if err != nil {
+		fmt.Printf("Error inserting into wtf_routes table: %v\n", err)
+	}
+	log.Println("Loaded page ", cacheKey)
+
+	app.totalRoutes.Add(1)
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts accepted by the date and datetime param types, in order of preference
+var (
+	dateLayouts     = []string{"2006-01-02"}
+	datetimeLayouts = []string{
+		time.RFC3339Nano,
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+		"2006-01-02 15:04",
+		"2006-01-02",
+	}
+)
+
+// paramTypes are the types accepted by @wtf-param
+var paramTypes = map[string]bool{
+	"string": true, "text": true,
+	"int": true, "integer": true,
+	"float": true, "number": true,
+	"bool": true, "boolean": true,
+	"json": true, "date": true, "datetime": true,
+}
+
+// checkParamDirectives checks the types and defaults of the @wtf-param directives
+// in a SQL blob, so mistakes are reported when a route is loaded instead of when
+// it's requested
+func checkParamDirectives(sqlBlob string) error {
+	for _, query := range ParseQueries(sqlBlob) {
+		for _, directive := range query.Directives {
+			if directive.name != "param" {
+				continue
+			}
+			if len(directive.params) < 2 {
+				return fmt.Errorf("@wtf-param requires a name and a type")
+			}
+
+			name, paramType := directive.params[0], strings.ToLower(directive.params[1])
+			if !paramTypes[paramType] {
+				return fmt.Errorf("unknown type '%s' for param '%s'", directive.params[1], name)
+			}
+			if len(directive.params) >= 3 {
+				if _, err := coerceParam(directive.params[2], paramType); err != nil {
+					return fmt.Errorf("invalid default for param '%s': %v", name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyParamDirectives coerces the bound variables declared with
+// `@wtf-param <name> <type> [default]` to their declared types.
+// Missing or empty params are replaced with the default if one was given,
+// and params without a default are bound as NULL.
+func applyParamDirectives(parsedQueries []ParsedQuery, varsMap map[string]any) error {
+	for _, query := range parsedQueries {
+		for _, directive := range query.Directives {
+			if directive.name != "param" || len(directive.params) < 2 {
+				continue
+			}
+
+			name, paramType := directive.params[0], strings.ToLower(directive.params[1])
+
+			value, exists := varsMap[name]
+			if str, ok := value.(string); !exists || (ok && str == "") {
+				// Declared params without a default are bound as NULL,
+				// except for empty strings which are valid string values
+				if len(directive.params) < 3 {
+					if !exists || (paramType != "string" && paramType != "text") {
+						varsMap[name] = nil
+					}
+					continue
+				}
+
+				defaultValue, err := coerceParam(directive.params[2], paramType)
+				if err != nil {
+					return fmt.Errorf("invalid default for param '%s': %v", name, err)
+				}
+				varsMap[name] = defaultValue
+				continue
+			}
+
+			// Values that aren't strings have already been coerced, or were captured by a query
+			str, ok := value.(string)
+			if !ok {
+				continue
+			}
+
+			coerced, err := coerceParam(str, paramType)
+			if err != nil {
+				return fmt.Errorf("invalid value for param '%s': %v", name, err)
+			}
+			varsMap[name] = coerced
+		}
+	}
+
+	return nil
+}
+
+// coerceParam converts a raw request value to the given param type
+func coerceParam(value, paramType string) (any, error) {
+	switch paramType {
+	case "string", "text":
+		return value, nil
+	case "int", "integer":
+		i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not an integer", value)
+		}
+		return i, nil
+	case "float", "number":
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a number", value)
+		}
+		return f, nil
+	case "bool", "boolean":
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "1", "t", "true", "on", "yes", "y":
+			return true, nil
+		case "0", "f", "false", "off", "no", "n":
+			return false, nil
+		}
+		return nil, fmt.Errorf("'%s' is not a boolean", value)
+	case "json":
+		// Compact the value so it's stored the same way SQLite's json() would
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, []byte(value)); err != nil {
+			return nil, fmt.Errorf("'%s' is not valid JSON", value)
+		}
+		return buf.String(), nil
+	case "date":
+		t, err := parseTimeLayouts(value, dateLayouts)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a date (expected YYYY-MM-DD)", value)
+		}
+		return t.Format("2006-01-02"), nil
+	case "datetime":
+		t, err := parseTimeLayouts(value, datetimeLayouts)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a datetime", value)
+		}
+		// Use the same format as SQLite's datetime() so comparisons work as expected
+		return t.UTC().Format("2006-01-02 15:04:05"), nil
+	}
+
+	return nil, fmt.Errorf("unknown param type '%s'", paramType)
+}
+
+// parseTimeLayouts parses the value with the first layout that matches
+func parseTimeLayouts(value string, layouts []string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	var err error
+	for _, layout := range layouts {
+		var t time.Time
+		t, err = time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, err
+}
@@ -1,6 +1,9 @@
 package main
 
-import "strings"
+import (
+	"strings"
+	"unicode"
+)
 
 type ParsedQuery struct {
 	Query      string
@@ -34,9 +37,57 @@ func ParseDirective(line string) Directive {
 		directive.params = parts[1:]
 	}
 
+	// Param defaults may be quoted, so they can contain spaces
+	if directive.name == "param" {
+		directive.params = splitQuoted(strings.TrimSpace(strings.TrimPrefix(line, parts[0])))
+	}
+
 	return directive
 }
 
+// splitQuoted splits a line into fields like strings.Fields, except that text in
+// single or double quotes is kept as one field, without the quotes. A quote is
+// written inside quotes by doubling it, the same way as in SQL strings.
+func splitQuoted(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inField := false
+	var quote rune
+
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote != 0 && r == quote:
+			if i+1 < len(runes) && runes[i+1] == quote {
+				field.WriteRune(r)
+				i++
+			} else {
+				quote = 0
+			}
+		case quote != 0:
+			field.WriteRune(r)
+		case r == '\'' || r == '"':
+			quote = r
+			inField = true
+		case unicode.IsSpace(r):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
 func ParseQueries(sqlBlob string) []ParsedQuery {
 	queries := strings.Split(sqlBlob, ";")
 
@@ -90,3 +141,25 @@ func ParseQueries(sqlBlob string) []ParsedQuery {
 
 	return parsedQueries
 }
+
+// HasDirective reports whether any line of the SQL blob carries the named directive,
+// including directives that aren't followed by a query
+func HasDirective(sqlBlob, name string) bool {
+	_, ok := FindDirective(sqlBlob, name)
+	return ok
+}
+
+// FindDirective returns the first directive with the given name in the SQL blob,
+// including directives that aren't followed by a query
+func FindDirective(sqlBlob, name string) (Directive, bool) {
+	for _, line := range strings.Split(sqlBlob, "\n") {
+		trimmedLine := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmedLine, "--") {
+			continue
+		}
+		if directive := ParseDirective(trimmedLine); directive.name == name {
+			return directive, true
+		}
+	}
+	return Directive{}, false
+}
@@ -1,15 +1,57 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"time"
+
+	"github.com/sad-pixel/wtfhttpd/udfs"
 )
 
+// requestIDRegex matches the request IDs accepted from the X-Request-Id header
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// routeContext returns the context a route runs in, which times out after the
+// `@wtf-timeout` of the route, or the configured request_timeout
+func routeContext(app *App, r *http.Request, content string) (context.Context, context.CancelFunc) {
+	timeout := app.Config.RequestTimeout
+	if directive, ok := FindDirective(content, "timeout"); ok && len(directive.params) > 0 {
+		if parsed, err := time.ParseDuration(directive.params[0]); err == nil {
+			timeout = parsed
+		} else {
+			log.Printf("Invalid @wtf-timeout '%s' for %s: %v", directive.params[0], r.URL.Path, err)
+		}
+	}
+
+	if timeout <= 0 {
+		return context.WithCancel(r.Context())
+	}
+	return context.WithTimeout(r.Context(), timeout)
+}
+
+// newRequestID returns the ID of a request, passed along from the X-Request-Id
+// header of a proxy in front of wtfhttpd, or generated
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); requestIDRegex.MatchString(id) {
+		return id
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
 // setupTemporaryTables creates all necessary temporary tables for the request
 func setupTemporaryTables(tx *sql.Tx) error {
 	tables := []string{
@@ -21,9 +63,12 @@ func setupTemporaryTables(tx *sql.Tx) error {
 		`CREATE TABLE wtfhttpd.path_params (name TEXT, value TEXT)`,
 		`CREATE TABLE wtfhttpd.request_cookies (name TEXT, value TEXT)`,
 		`CREATE TABLE wtfhttpd.request_json (path TEXT PRIMARY KEY NOT NULL, value ANY, type TEXT NOT NULL, json TEXT)`,
+		`CREATE TABLE wtfhttpd.request_flash (name TEXT, value TEXT)`,
+		`CREATE TABLE wtfhttpd.request_auth (name TEXT, value ANY)`,
 
 		// "Magic Tables" for the response
 		`CREATE TABLE wtfhttpd.response_meta (name TEXT PRIMARY KEY, value TEXT)`,
+		`CREATE TABLE wtfhttpd.response_flash (name TEXT PRIMARY KEY, value TEXT)`,
 		`CREATE TABLE wtfhttpd.response_cookies (
 			name TEXT NOT NULL,
 			value TEXT NOT NULL,
@@ -46,13 +91,14 @@ func setupTemporaryTables(tx *sql.Tx) error {
 	return nil
 }
 
-// populateTemporaryTables fills the temporary tables with request data
-func populateTemporaryTables(tx *sql.Tx, r *http.Request, pathParams []string, cfg *Config) error {
+// populateTemporaryTables fills the temporary tables with request data.
+// The raw body is only kept when rawBody is set.
+func populateTemporaryTables(tx *sql.Tx, r *http.Request, pathParams []string, cfg *Config, flashKey []byte, rawBody bool) error {
 	stmts := make(map[string]*sql.Stmt)
 	tables := []string{
 		"query_params", "request_meta", "request_form",
 		"request_headers", "env_vars", "path_params",
-		"request_cookies",
+		"request_cookies", "request_flash",
 	}
 
 	for _, table := range tables {
@@ -99,6 +145,12 @@ func populateTemporaryTables(tx *sql.Tx, r *http.Request, pathParams []string, c
 		}
 	}
 
+	for name, value := range readFlash(r, flashKey) {
+		if _, err := stmts["request_flash"].Exec(name, value); err != nil {
+			return fmt.Errorf("Error inserting flash data: %v", err)
+		}
+	}
+
 	metaData := []struct {
 		name  string
 		value string
@@ -128,6 +180,19 @@ func populateTemporaryTables(tx *sql.Tx, r *http.Request, pathParams []string, c
 		}
 	}
 
+	// Routes can ask for the raw body, so signatures of webhooks can be checked whatever their content type
+	if rawBody {
+		body, err := readRawBody(r)
+		if err != nil {
+			return err
+		}
+		if len(body) > 0 {
+			if _, err := stmts["request_meta"].Exec("body", string(body)); err != nil {
+				return fmt.Errorf("Error inserting request body: %v", err)
+			}
+		}
+	}
+
 	// Parse form data if content type is application/x-www-form-urlencoded or multipart/form-data
 	if strings.Contains(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") ||
 		strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
@@ -171,3 +236,80 @@ func populateTemporaryTables(tx *sql.Tx, r *http.Request, pathParams []string, c
 
 	return nil
 }
+
+// wantsRawBody reports whether a route, or a _before.sql middleware running before it,
+// asks for the raw body with @wtf-raw-body
+func wantsRawBody(routes *routeTable, trimmedPath, content string) bool {
+	if HasDirective(content, "raw-body") {
+		return true
+	}
+	for _, file := range routes.middleware[trimmedPath].before {
+		if HasDirective(routes.sqlCache[file], "raw-body") {
+			return true
+		}
+	}
+	return false
+}
+
+// rawBodyLimit is the largest request body kept in request_meta, the same as the
+// limit of the form parser
+const rawBodyLimit = 10 << 20
+
+// readRawBody reads the body of a request, and puts it back for the form and JSON
+// parsers. It returns nil if the body is larger than rawBodyLimit.
+func readRawBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, rawBodyLimit+1))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading request body: %w", err)
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+	if len(body) > rawBodyLimit {
+		return nil, nil
+	}
+	return body, nil
+}
+
+// populateRequestAuth verifies the bearer token of the Authorization header, and
+// fills the request_auth table with its claims. Invalid tokens leave it empty.
+func populateRequestAuth(tx *sql.Tx, r *http.Request, jwt *udfs.JWT) error {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil
+	}
+
+	claims, err := jwt.Verify(strings.TrimSpace(token), "")
+	if err != nil {
+		return nil
+	}
+
+	for name, value := range claims {
+		switch v := value.(type) {
+		case map[string]any, []any:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			value = string(encoded)
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				value = n
+			} else {
+				value, _ = v.Float64()
+			}
+		}
+
+		if _, err := tx.Exec("INSERT INTO request_auth (name, value) VALUES (?, ?)", name, value); err != nil {
+			return fmt.Errorf("Error inserting auth claim: %v", err)
+		}
+	}
+
+	return nil
+}
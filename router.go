@@ -8,19 +8,17 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
-
-	"github.com/nikolalohinski/gonja/v2"
 )
 
 // setupRoutes walks through the webroot directory and sets up HTTP routes
-func setupRoutes(app *App, mux *http.ServeMux) error {
+func setupRoutes(app *App, routes *routeTable, mux *http.ServeMux) error {
 	return filepath.Walk(app.Config.WebRoot, func(path string, info os.FileInfo, err error) error {
-		return processFile(app, path, info, err, mux)
+		return processFile(app, routes, path, info, err, mux)
 	})
 }
 
-// processFile handles each file found during directory walk
-func processFile(app *App, path string, info os.FileInfo, err error, mux *http.ServeMux) error {
+// processFile handles each file found during directory walk, loading it into the route table
+func processFile(app *App, routes *routeTable, path string, info os.FileInfo, err error, mux *http.ServeMux) error {
 	if err != nil {
 		return err
 	}
@@ -34,17 +32,22 @@ func processFile(app *App, path string, info os.FileInfo, err error, mux *http.S
 	file := filepath.Base(relativePath)
 	ext := filepath.Ext(file)
 
+	if isPagePath(relativePath) {
+		return processPage(app, routes, relativePath, mux)
+	}
+
 	if strings.Contains(file, ".tpl") {
 		// Trim the leading slash for display and map key
 		displayPath := strings.TrimPrefix(relativePath, "/")
 		log.Println("Discovered Template: ", displayPath)
-		template, err := gonja.FromFile(path)
+		template, deps, err := app.loadTemplate(displayPath)
 		if err != nil {
-			log.Printf("Error loading template %s: %v", file, err)
+			log.Printf("Error loading template %s: %v", displayPath, err)
 			return nil
 		}
 
-		app.tpl[displayPath] = template
+		routes.tpl[displayPath] = template
+		routes.tplDeps[displayPath] = deps
 		return nil
 	}
 
@@ -52,6 +55,40 @@ func processFile(app *App, path string, info os.FileInfo, err error, mux *http.S
 		return nil
 	}
 
+	// Partials are only ever spliced into other routes with @wtf-include
+	if isPartialPath(relativePath) {
+		log.Println("Discovered partial: ", strings.TrimPrefix(relativePath, "/"))
+		return nil
+	}
+
+	// Read the SQL file content and store it in the sqlCache. A route that fails
+	// to load is skipped, so one broken file doesn't take the other routes down.
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Error reading SQL file %s: %v", path, err)
+		return nil
+	}
+	// Trim the leading slash for consistency
+	cacheKey := strings.TrimPrefix(relativePath, "/")
+
+	expanded, err := expandIncludes(app.Config.WebRoot, string(content), []string{cacheKey})
+	if err != nil {
+		log.Printf("Error expanding includes in %s: %v", path, err)
+		return nil
+	}
+	if err := checkParamDirectives(expanded); err != nil {
+		log.Printf("Error in %s: %v", path, err)
+		return nil
+	}
+
+	middleware, err := loadMiddleware(app, routes, cacheKey)
+	if err != nil {
+		log.Printf("Error loading middleware for %s: %v", path, err)
+		return nil
+	}
+	routes.sqlCache[cacheKey] = expanded
+	routes.middleware[cacheKey] = middleware
+
 	fileName := strings.TrimSuffix(file, ext)
 	dir := filepath.Dir(relativePath)
 
@@ -64,15 +101,6 @@ func processFile(app *App, path string, info os.FileInfo, err error, mux *http.S
 		registerGenericRoute(app, fileName, dir, relativePath, mux)
 	}
 
-	// Read the SQL file content and store it in the sqlCache
-	content, err := os.ReadFile(path)
-	if err != nil {
-		log.Printf("Error reading SQL file %s: %v", path, err)
-		return err
-	}
-	// Trim the leading slash for consistency
-	cacheKey := strings.TrimPrefix(relativePath, "/")
-	app.sqlCache[cacheKey] = string(content)
 	log.Println("Loaded route file ", cacheKey)
 
 	app.totalRoutes.Add(1)
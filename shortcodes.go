@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nikolalohinski/gonja/v2/exec"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// shortcodeRegex matches shortcodes in markdown, e.g. {{< query "_recent.sql" limit=5 >}}
+var shortcodeRegex = regexp.MustCompile(`\{\{<\s*(\w+)(.*?)\s*>\}\}`)
+
+// shortcodeArgRegex matches the arguments of a shortcode, either positional or key=value,
+// with the value optionally quoted
+var shortcodeArgRegex = regexp.MustCompile(`(?:(\w+)=)?(?:"([^"]*)"|(\S+))`)
+
+// shortcodePlaceholder stands in for a shortcode while the markdown is rendered.
+// It's made of letters and digits only, so no markdown extension changes it.
+const shortcodePlaceholder = "WTFSHORTCODE%dEND"
+
+// protectShortcodes replaces the shortcodes in markdown with placeholders. Shortcodes
+// in code spans and code blocks are left alone, so they're rendered as code, and
+// the shortcode syntax can be documented in content.
+func protectShortcodes(source string) (string, []string) {
+	code := codeRanges([]byte(source))
+
+	var shortcodes []string
+	var b strings.Builder
+	last := 0
+	for _, match := range shortcodeRegex.FindAllStringIndex(source, -1) {
+		if inRanges(code, match[0], match[1]) {
+			continue
+		}
+
+		shortcodes = append(shortcodes, source[match[0]:match[1]])
+		b.WriteString(source[last:match[0]])
+		fmt.Fprintf(&b, shortcodePlaceholder, len(shortcodes)-1)
+		last = match[1]
+	}
+	b.WriteString(source[last:])
+
+	return b.String(), shortcodes
+}
+
+// codeRanges returns the byte ranges of the code spans and code blocks in markdown
+func codeRanges(source []byte) [][2]int {
+	var ranges [][2]int
+	doc := markdownRenderer.Parser().Parse(text.NewReader(source))
+
+	ast.Walk(doc, func(node ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch node.Kind() {
+		case ast.KindCodeBlock, ast.KindFencedCodeBlock:
+			lines := node.Lines()
+			for i := 0; i < lines.Len(); i++ {
+				line := lines.At(i)
+				ranges = append(ranges, [2]int{line.Start, line.Stop})
+			}
+			return ast.WalkSkipChildren, nil
+		case ast.KindCodeSpan:
+			for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+				if t, ok := child.(*ast.Text); ok {
+					ranges = append(ranges, [2]int{t.Segment.Start, t.Segment.Stop})
+				}
+			}
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+
+	return ranges
+}
+
+// inRanges reports whether the span from start to end overlaps any of the ranges
+func inRanges(ranges [][2]int, start, end int) bool {
+	for _, r := range ranges {
+		if start < r[1] && end > r[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreShortcodes puts the shortcodes back into the rendered HTML. A shortcode
+// on a line of its own isn't wrapped in a paragraph, so it can embed block elements.
+func restoreShortcodes(rendered string, shortcodes []string) string {
+	for i, shortcode := range shortcodes {
+		placeholder := fmt.Sprintf(shortcodePlaceholder, i)
+		rendered = strings.ReplaceAll(rendered, "<p>"+placeholder+"</p>", shortcode)
+		rendered = strings.ReplaceAll(rendered, placeholder, shortcode)
+	}
+	return rendered
+}
+
+// shortcodeRenderer returns the shortcodes(html) template function, which expands the
+// shortcodes in rendered markdown. Partials see the same context as the calling template.
+func shortcodeRenderer(app *App, contextData map[string]any) func(*exec.VarArgs) *exec.Value {
+	return func(args *exec.VarArgs) *exec.Value {
+		p := args.ExpectArgs(1)
+		if p.IsError() {
+			return exec.AsValue(exec.ErrInvalidCall(fmt.Errorf("wrong signature for 'shortcodes': %s", p.Error())))
+		}
+
+		return exec.AsSafeValue(app.expandShortcodes(p.Args[0].String(), contextData))
+	}
+}
+
+// expandShortcodes expands every shortcode in rendered markdown
+func (app *App) expandShortcodes(rendered string, contextData map[string]any) string {
+	return shortcodeRegex.ReplaceAllStringFunc(rendered, func(shortcode string) string {
+		match := shortcodeRegex.FindStringSubmatch(shortcode)
+		output, err := app.expandShortcode(match[1], match[2], contextData)
+		if err != nil {
+			log.Printf("Error expanding shortcode %s: %v", shortcode, err)
+			if app.Config.DevMode {
+				return fmt.Sprintf("<pre>%s: %s</pre>", html.EscapeString(shortcode), html.EscapeString(err.Error()))
+			}
+			return ""
+		}
+		return output
+	})
+}
+
+// expandShortcode renders a single shortcode.
+//
+//	{{< query "_recent.sql" [partial="_list.html"] [key=value...] >}}
+//	{{< partial "_chart.html" [key=value...] >}}
+func (app *App) expandShortcode(name, rawArgs string, contextData map[string]any) (string, error) {
+	var positional []string
+	kwargs := make(map[string]any)
+	for _, arg := range shortcodeArgRegex.FindAllStringSubmatch(rawArgs, -1) {
+		value := arg[2] + arg[3]
+		if arg[1] == "" {
+			positional = append(positional, value)
+		} else {
+			kwargs[arg[1]] = value
+		}
+	}
+
+	if len(positional) != 1 {
+		return "", fmt.Errorf("the %s shortcode takes one file name, got %d", name, len(positional))
+	}
+
+	switch name {
+	case "query":
+		partial, _ := kwargs["partial"].(string)
+		delete(kwargs, "partial")
+
+		rows, err := app.queryFile(positional[0], kwargs)
+		if err != nil {
+			return "", err
+		}
+
+		if partial == "" {
+			return shortcodeTable(rows), nil
+		}
+		kwargs["rows"] = rows
+		return app.renderPartial(partial, contextData, kwargs)
+	case "partial":
+		return app.renderPartial(positional[0], contextData, kwargs)
+	}
+
+	return "", fmt.Errorf("unknown shortcode '%s'", name)
+}
+
+// queryFile runs a SQL file from the webroot in a transaction that's rolled back,
+// with the given named parameters, and returns the rows of the last query.
+// Like included files, the file has to be a .sql file inside the webroot.
+func (app *App) queryFile(file string, params map[string]any) ([]map[string]any, error) {
+	file, err := resolveIncludePath(filepath.ToSlash(file))
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filepath.Join(app.Config.WebRoot, file))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", file, err)
+	}
+
+	expanded, err := expandIncludes(app.Config.WebRoot, string(content), []string{file})
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := app.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows := []map[string]any{}
+	for _, query := range ParseQueries(expanded) {
+		results, err := executeQuery(tx, query.Query, params)
+		if err != nil {
+			return nil, err
+		}
+		rows = results
+	}
+
+	return rows, nil
+}
+
+// renderPartial renders a template with the context of the calling template, and the given values
+func (app *App) renderPartial(name string, contextData map[string]any, values map[string]any) (string, error) {
+	template, ok := app.currentRoutes().tpl[name]
+
+	if !ok {
+		loaded, deps, err := app.loadTemplate(name)
+		if err != nil {
+			return "", err
+		}
+
+		app.mu.Lock()
+		routes := app.routes.withTemplates()
+		routes.tpl[name] = loaded
+		routes.tplDeps[name] = deps
+		app.routes = routes
+		app.mu.Unlock()
+		template = loaded
+	}
+
+	data := make(map[string]any, len(contextData)+len(values))
+	for key, value := range contextData {
+		data[key] = value
+	}
+	for key, value := range values {
+		data[key] = value
+	}
+
+	return template.ExecuteToString(exec.NewContext(data))
+}
+
+// shortcodeTable renders query results as an HTML table, for query shortcodes without a partial
+func shortcodeTable(rows []map[string]any) string {
+	if len(rows) == 0 {
+		return ""
+	}
+
+	var columns []string
+	for column := range rows[0] {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	var b strings.Builder
+	b.WriteString("<table>\n<thead>\n<tr>")
+	for _, column := range columns {
+		fmt.Fprintf(&b, "<th>%s</th>", html.EscapeString(column))
+	}
+	b.WriteString("</tr>\n</thead>\n<tbody>\n")
+	for _, row := range rows {
+		b.WriteString("<tr>")
+		for _, column := range columns {
+			value := ""
+			if row[column] != nil {
+				value = fmt.Sprint(row[column])
+			}
+			fmt.Fprintf(&b, "<td>%s</td>", html.EscapeString(value))
+		}
+		b.WriteString("</tr>\n")
+	}
+	b.WriteString("</tbody>\n</table>")
+	return b.String()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/nikolalohinski/gonja/v2/exec"
+)
+
+// flashCookieName is the cookie used to carry flash data to the next request
+const flashCookieName = "wtf_flash"
+
+// buildTemplateContext creates the data available to templates: the globals and query
+// results, plus the request, session, flash data, env vars and url_for helper
+func buildTemplateContext(app *App, r *http.Request, pathParams []string, globals map[string]any, results map[string][]map[string]any) map[string]any {
+	contextData := make(map[string]interface{})
+	for key, value := range globals {
+		contextData[key] = value
+	}
+	for key, value := range results {
+		contextData[key] = value
+	}
+
+	query := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		if len(values) > 0 {
+			query[key] = values[0]
+		}
+	}
+
+	headers := make(map[string]string)
+	for key, values := range r.Header {
+		if len(values) > 0 {
+			headers[key] = values[0]
+		}
+	}
+
+	cookies := make(map[string]string)
+	for _, cookie := range r.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+
+	params := make(map[string]string)
+	for _, param := range pathParams {
+		params[param] = r.PathValue(param)
+	}
+
+	contextData["request"] = map[string]any{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"host":        r.Host,
+		"remote_addr": r.RemoteAddr,
+		"request_uri": r.RequestURI,
+		"query":       query,
+		"headers":     headers,
+		"cookies":     cookies,
+		"path_params": params,
+	}
+
+	// A single row stored with `@wtf-store session` is exposed as the session itself
+	session := map[string]any{}
+	if rows, ok := results["session"]; ok && len(rows) > 0 {
+		session = rows[0]
+	}
+	contextData["session"] = session
+
+	contextData["flash"] = readFlash(r, app.flashKey)
+
+	env := make(map[string]string)
+	for _, name := range app.Config.TemplateEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+	contextData["env"] = env
+
+	contextData["url_for"] = urlFor(app)
+	contextData["content_list"] = contentList(app)
+	contextData["content_tags"] = contentTagList(app)
+	contextData["content_search"] = contentSearch(app)
+	contextData["shortcodes"] = shortcodeRenderer(app, contextData)
+
+	return contextData
+}
+
+// urlFor returns the url_for(route_file, [params]) template function.
+// Path params are filled in from params, and the remaining params become the query string.
+func urlFor(app *App) func(*exec.VarArgs) *exec.Value {
+	return func(args *exec.VarArgs) *exec.Value {
+		if len(args.Args) < 1 || len(args.Args) > 2 {
+			return exec.AsValue(exec.ErrInvalidCall(fmt.Errorf("expected 1 or 2 arguments, got %d", len(args.Args))))
+		}
+
+		file := "/" + strings.TrimPrefix(args.Args[0].String(), "/")
+
+		routePath, ok := app.currentRoutes().routePaths[file]
+		if !ok {
+			return exec.AsValue(fmt.Errorf("no route is handled by %s", file))
+		}
+
+		params := make(map[string]string)
+		if len(args.Args) == 2 && args.Args[1].IsDict() {
+			args.Args[1].Iterate(func(idx, count int, key, value *exec.Value) bool {
+				params[key.String()] = value.String()
+				return true
+			}, func() {})
+		}
+
+		routePath = strings.TrimSuffix(routePath, "{$}")
+		pathParams := extractPathParams(routePath)
+		for _, param := range pathParams {
+			value, ok := params[param]
+			if !ok {
+				return exec.AsValue(fmt.Errorf("missing path param '%s' for %s", param, file))
+			}
+			routePath = strings.Replace(routePath, "{"+param+"}", url.PathEscape(value), 1)
+		}
+
+		queryValues := url.Values{}
+		for key, value := range params {
+			if !slices.Contains(pathParams, key) {
+				queryValues.Set(key, value)
+			}
+		}
+
+		if len(queryValues) > 0 {
+			routePath += "?" + queryValues.Encode()
+		}
+
+		return exec.AsValue(routePath)
+	}
+}
+
+// loadRoutePaths maps the files handling routes to their paths, for url_for.
+// Files handling more than one route map to the first one registered.
+func loadRoutePaths(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("SELECT file, path FROM wtf_routes ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error querying wtf_routes: %v", err)
+	}
+	defer rows.Close()
+
+	routePaths := make(map[string]string)
+	for rows.Next() {
+		var file, path string
+		if err := rows.Scan(&file, &path); err != nil {
+			return nil, fmt.Errorf("error scanning wtf_routes: %v", err)
+		}
+		if _, ok := routePaths[file]; !ok {
+			routePaths[file] = path
+		}
+	}
+	return routePaths, rows.Err()
+}
+
+// newFlashKey derives the key that signs flash cookies from the secret key.
+// Without a secret, a random key is used, so flash data doesn't survive restarts.
+func newFlashKey(secret string) ([]byte, error) {
+	if secret == "" {
+		log.Println("No secret key set, flash cookies are signed with a random key")
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		return key, err
+	}
+
+	return hkdf.Key(sha256.New, []byte(secret), nil, "wtfhttpd flash", 32)
+}
+
+// signFlash returns the HMAC of an encoded flash cookie value
+func signFlash(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// readFlash decodes the flash data set by the previous request.
+// Cookies without a valid signature are ignored.
+func readFlash(r *http.Request, key []byte) map[string]string {
+	flash := make(map[string]string)
+
+	cookie, err := r.Cookie(flashCookieName)
+	if err != nil {
+		return flash
+	}
+
+	payload, signature, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return flash
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, signFlash(key, payload)) {
+		return flash
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return flash
+	}
+
+	json.Unmarshal(data, &flash)
+	return flash
+}
+
+// writeFlash carries the rows of the response_flash table over to the next request.
+// Flash data from the current request is cleared once it has been rendered by
+// a template, so requests for JSON or assets in between don't lose it.
+func writeFlash(tx *sql.Tx, w http.ResponseWriter, r *http.Request, key []byte, rendered bool) error {
+	rows, err := tx.Query("SELECT name, value FROM response_flash")
+	if err != nil {
+		return fmt.Errorf("Error querying response flash: %v", err)
+	}
+	defer rows.Close()
+
+	flash := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return fmt.Errorf("Error scanning flash row: %v", err)
+		}
+		flash[name] = value
+	}
+
+	if len(flash) == 0 {
+		if _, err := r.Cookie(flashCookieName); err == nil && rendered {
+			http.SetCookie(w, &http.Cookie{Name: flashCookieName, Path: "/", MaxAge: -1})
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(flash)
+	if err != nil {
+		return fmt.Errorf("Error encoding flash: %v", err)
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookieName,
+		Value:    payload + "." + base64.RawURLEncoding.EncodeToString(signFlash(key, payload)),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	ut "github.com/go-playground/universal-translator"
+	"github.com/nikolalohinski/gonja/v2"
+	"github.com/nikolalohinski/gonja/v2/exec"
+	"github.com/sad-pixel/wtfhttpd/udfs"
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// globalsFile is the webroot script whose results are available to every template
+const globalsFile = "_globals.sql"
+
+// templateFunctions are the UDFs available to templates by default. None of them
+// have side effects, so rendering a template can't change anything the route's
+// queries didn't. Others, like http_get or cache_get, can be added with the
+// template_functions config option.
+var templateFunctions = []string{
+	"slugify", "build_query", "parse_query",
+	"checksum_md5", "checksum_sha1", "sha256", "sha256_base64", "sha512", "sha512_base64",
+	"hmac_sha256", "hmac_sha256_base64", "hmac_sha512", "hmac_sha512_base64", "secure_compare",
+	"base64_encode", "base64_decode", "url_encode", "url_decode", "html_escape", "markdown_to_html",
+	"uuid_v4", "uuid_v7", "ulid", "nanoid",
+	"regexp_match", "regexp_replace", "regexp_extract", "sprintf", "truncate_words",
+	"time_now", "time_format", "time_add", "time_diff", "time_relative", "time_humanize",
+	"time_start_of", "time_end_of", "search_highlight", "search_snippet",
+}
+
+// requestTemplateFunctions are the template functions that use the request they're called
+// for. Templates rendered for a request get them bound to it.
+var requestTemplateFunctions []udfs.Function
+
+// registerTemplateFunctions makes the template UDFs, along with the extra ones named
+// in the config, available to templates, both as a global function and as a filter
+// that passes the filtered value as the first argument.
+// The built-in template filters are registered along with them.
+func registerTemplateFunctions(functions []udfs.Function, extra []string) {
+	allowed := make(map[string]bool)
+	for _, name := range append(slices.Clone(templateFunctions), extra...) {
+		allowed[name] = true
+	}
+
+	for _, fn := range functions {
+		if !allowed[fn.Name] {
+			continue
+		}
+		delete(allowed, fn.Name)
+
+		if err := gonja.DefaultEnvironment.Filters.Register(fn.Name, udfFilter(fn)); err != nil {
+			log.Printf("Not registering %s as a template filter: %v", fn.Name, err)
+		}
+
+		if gonja.DefaultEnvironment.Context.Has(fn.Name) {
+			log.Printf("Not registering %s as a template function: the name is already in use", fn.Name)
+			continue
+		}
+		gonja.DefaultEnvironment.Context.Set(fn.Name, udfFunction(fn, nil))
+
+		if fn.UsesRequest() {
+			requestTemplateFunctions = append(requestTemplateFunctions, fn)
+		}
+	}
+
+	for name := range allowed {
+		log.Printf("Not registering %s as a template function: there's no function with that name", name)
+	}
+
+	filters := map[string]exec.FilterFunction{
+		"markdown": filterMarkdown,
+		"number":   filterNumber,
+		"currency": filterCurrency,
+		"json":     filterJSON,
+	}
+
+	for name, filter := range filters {
+		if err := gonja.DefaultEnvironment.Filters.Register(name, filter); err != nil {
+			log.Fatalf("Error registering %s template filter: %v", name, err)
+		}
+	}
+}
+
+// bindRequestFunctions returns a copy of the template data with the template functions that
+// use the request bound to the request the template is rendered for
+func bindRequestFunctions(data map[string]any, req *udfs.BoundRequest) map[string]any {
+	bound := maps.Clone(data)
+	for _, fn := range requestTemplateFunctions {
+		bound[fn.Name] = udfFunction(fn, req)
+	}
+	return bound
+}
+
+// udfFilter wraps a UDF as a template filter, e.g. {{ post.created_at | time_relative }}.
+// It calls the template function of the same name, if there is one, so it's bound to
+// the same request.
+func udfFilter(fn udfs.Function) exec.FilterFunction {
+	return func(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+		if in.IsError() {
+			return in
+		}
+
+		args := &exec.VarArgs{Args: append([]*exec.Value{in}, params.Args...), KwArgs: params.KwArgs}
+		if value, ok := e.Environment.Context.Get(fn.Name); ok {
+			if function, ok := value.(func(*exec.VarArgs) *exec.Value); ok {
+				return function(args)
+			}
+		}
+		return callUdf(fn, nil, args.Args, args.KwArgs)
+	}
+}
+
+// udfFunction wraps a UDF as a template function, e.g. {{ time_now("15:04") }}, calling
+// it for the given request, if any
+func udfFunction(fn udfs.Function, req *udfs.BoundRequest) func(*exec.VarArgs) *exec.Value {
+	return func(params *exec.VarArgs) *exec.Value {
+		return callUdf(fn, req, params.Args, params.KwArgs)
+	}
+}
+
+// callUdf converts the template values to the types SQLite would pass, and calls the UDF
+func callUdf(fn udfs.Function, req *udfs.BoundRequest, values []*exec.Value, kwargs map[string]*exec.Value) *exec.Value {
+	if len(kwargs) > 0 {
+		return exec.AsValue(exec.ErrInvalidCall(fmt.Errorf("%s does not take keyword arguments", fn.Name)))
+	}
+
+	if fn.NArgs >= 0 && len(values) != int(fn.NArgs) {
+		return exec.AsValue(exec.ErrInvalidCall(fmt.Errorf("%s expects %d arguments, got %d", fn.Name, fn.NArgs, len(values))))
+	}
+
+	args := make([]driver.Value, len(values))
+	for i, value := range values {
+		arg, err := udfArgument(value)
+		if err != nil {
+			return exec.AsValue(fmt.Errorf("%s: %v", fn.Name, err))
+		}
+		args[i] = arg
+	}
+
+	result, err := req.Call(fn, args)
+	if err != nil {
+		return exec.AsValue(fmt.Errorf("%s: %v", fn.Name, err))
+	}
+
+	if b, ok := result.([]byte); ok {
+		return exec.AsValue(string(b))
+	}
+	return exec.AsValue(result)
+}
+
+// udfArgument converts a template value to a SQLite value.
+// Booleans become integers, and lists and dicts are passed as JSON.
+func udfArgument(value *exec.Value) (driver.Value, error) {
+	switch {
+	case value.IsError():
+		return nil, fmt.Errorf("%s", value.Error())
+	case value.IsNil():
+		return nil, nil
+	case value.IsBool():
+		if value.Bool() {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case value.IsInteger():
+		return int64(value.Integer()), nil
+	case value.IsFloat():
+		return value.Float(), nil
+	case value.IsString():
+		return value.String(), nil
+	case value.IsList(), value.IsDict():
+		data := value.ToGoSimpleType(true)
+		if err, ok := data.(error); ok {
+			return nil, err
+		}
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		return string(encoded), nil
+	}
+
+	return value.String(), nil
+}
+
+// filterMarkdown renders markdown with the same settings as the content index
+func filterMarkdown(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+
+	if p := params.ExpectNothing(); p.IsError() {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'markdown': %s", p.Error()))
+	}
+
+	rendered, _, err := renderMarkdown(in.String())
+	if err != nil {
+		return exec.AsValue(fmt.Errorf("error rendering markdown: %v", err))
+	}
+
+	return exec.AsSafeValue(rendered)
+}
+
+// filterNumber formats a number with the grouping and decimal separators of a locale,
+// e.g. {{ total | number(2, locale="de") }}
+func filterNumber(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+
+	p := params.Expect(0, []*exec.KwArg{{Name: "decimals", Default: nil}, {Name: "locale", Default: "en"}})
+	if p.IsError() {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'number': %s", p.Error()))
+	}
+
+	value, err := filterFloat(in)
+	if err != nil {
+		return exec.AsValue(fmt.Errorf("number: %v", err))
+	}
+
+	var options []number.Option
+	if decimals := p.KwArgs["decimals"]; !decimals.IsNil() {
+		options = append(options, number.Scale(decimals.Integer()))
+	}
+
+	printer := message.NewPrinter(language.Make(p.KwArgs["locale"].String()))
+	return exec.AsValue(printer.Sprint(number.Decimal(value, options...)))
+}
+
+// filterCurrency formats an amount in a currency given by its ISO 4217 code,
+// e.g. {{ price | currency("EUR") }}
+func filterCurrency(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+
+	p := params.Expect(0, []*exec.KwArg{{Name: "code", Default: "USD"}, {Name: "locale", Default: "en"}})
+	if p.IsError() {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'currency': %s", p.Error()))
+	}
+
+	value, err := filterFloat(in)
+	if err != nil {
+		return exec.AsValue(fmt.Errorf("currency: %v", err))
+	}
+
+	unit, err := currency.ParseISO(p.KwArgs["code"].String())
+	if err != nil {
+		return exec.AsValue(fmt.Errorf("currency: unknown currency code '%s'", p.KwArgs["code"].String()))
+	}
+
+	printer := message.NewPrinter(language.Make(p.KwArgs["locale"].String()))
+	return exec.AsValue(printer.Sprint(currency.Symbol(unit.Amount(value))))
+}
+
+// filterFloat reads a number from a filtered value, parsing strings as needed
+func filterFloat(in *exec.Value) (float64, error) {
+	if in.IsNumber() {
+		return in.Float(), nil
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(in.String()), 64)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a number", in.String())
+	}
+	return value, nil
+}
+
+// filterJSON decodes a JSON string, such as a metadata column or an http_get response,
+// so its fields can be used in the template. Use tojson to encode values instead.
+func filterJSON(e *exec.Evaluator, in *exec.Value, params *exec.VarArgs) *exec.Value {
+	if in.IsError() {
+		return in
+	}
+
+	if p := params.ExpectNothing(); p.IsError() {
+		return exec.AsValue(fmt.Errorf("wrong signature for 'json': %s", p.Error()))
+	}
+
+	if !in.IsString() {
+		return in
+	}
+
+	var decoded any
+	if err := json.Unmarshal([]byte(in.String()), &decoded); err != nil {
+		return exec.AsValue(fmt.Errorf("json: %v", err))
+	}
+
+	return exec.AsValue(jsonIntegers(decoded))
+}
+
+// jsonIntegers turns whole numbers decoded from JSON back into integers,
+// so they aren't printed with a decimal point
+func jsonIntegers(value any) any {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = jsonIntegers(item)
+		}
+	case map[string]any:
+		for key, item := range v {
+			v[key] = jsonIntegers(item)
+		}
+	}
+	return value
+}
+
+// loadGlobals reads the optional _globals.sql script from the webroot into the sqlCache
+func loadGlobals(app *App, routes *routeTable) error {
+	content, err := os.ReadFile(filepath.Join(app.Config.WebRoot, globalsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading %s: %v", globalsFile, err)
+	}
+
+	expanded, err := expandIncludes(app.Config.WebRoot, string(content), []string{globalsFile})
+	if err != nil {
+		return err
+	}
+	if err := checkParamDirectives(expanded); err != nil {
+		return fmt.Errorf("%s: %v", globalsFile, err)
+	}
+
+	routes.sqlCache[globalsFile] = expanded
+	log.Println("Loaded template globals ", globalsFile)
+	return nil
+}
+
+// templateGlobals runs _globals.sql inside the request transaction. Results stored
+// with @wtf-store become globals under their key, and the columns of the first row
+// of every other query become globals by name.
+// On failure, it returns the HTTP status code that should be sent.
+func templateGlobals(app *App, routes *routeTable, tx *sql.Tx, trans ut.Translator, varsMap map[string]any) (map[string]any, int, error) {
+	globals := make(map[string]any)
+
+	content, ok := routes.sqlCache[globalsFile]
+	if !ok {
+		return globals, http.StatusOK, nil
+	}
+
+	for _, query := range ParseQueries(content) {
+		results := make(map[string][]map[string]any)
+		if code, err := executeQueries(app, tx, trans, []ParsedQuery{query}, varsMap, results, true); err != nil {
+			return nil, code, err
+		}
+
+		for key, rows := range results {
+			if key != "ctx" {
+				globals[key] = rows
+				continue
+			}
+
+			if len(rows) > 0 {
+				for column, value := range rows[0] {
+					globals[column] = value
+				}
+			}
+		}
+	}
+
+	return globals, http.StatusOK, nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nikolalohinski/gonja/v2"
+	"github.com/nikolalohinski/gonja/v2/exec"
+	"github.com/nikolalohinski/gonja/v2/loaders"
+)
+
+// layoutsDir is the directory inside the webroot searched for templates that
+// aren't found relative to the webroot itself
+const layoutsDir = "layouts"
+
+// templateDeps records every file read while loading or rendering a template
+type templateDeps struct {
+	mu    sync.Mutex
+	files map[string]bool
+}
+
+func (deps *templateDeps) add(file string) {
+	deps.mu.Lock()
+	deps.files[file] = true
+	deps.mu.Unlock()
+}
+
+func (deps *templateDeps) list() []string {
+	deps.mu.Lock()
+	defer deps.mu.Unlock()
+
+	files := make([]string, 0, len(deps.files))
+	for file := range deps.files {
+		files = append(files, file)
+	}
+	return files
+}
+
+// webrootLoader is a gonja loader that resolves template names against the webroot,
+// falling back to the shared layouts directory. Names starting with ./ or ../ are
+// resolved relative to the template that references them.
+type webrootLoader struct {
+	root    string
+	current string
+	deps    *templateDeps
+}
+
+func newWebrootLoader(webRoot string) (*webrootLoader, error) {
+	root, err := filepath.Abs(webRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webrootLoader{
+		root: root,
+		deps: &templateDeps{files: make(map[string]bool)},
+	}, nil
+}
+
+// relative returns the webroot-relative name of an absolute path
+func (l *webrootLoader) relative(path string) string {
+	rel, err := filepath.Rel(l.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (l *webrootLoader) Resolve(name string) (string, error) {
+	var candidates []string
+
+	switch {
+	case filepath.IsAbs(name):
+		candidates = []string{filepath.Clean(name)}
+	case (strings.HasPrefix(name, "./") || strings.HasPrefix(name, "../")) && l.current != "":
+		candidates = []string{filepath.Join(filepath.Dir(l.current), name)}
+	default:
+		candidates = []string{
+			filepath.Join(l.root, name),
+			filepath.Join(l.root, layoutsDir, name),
+		}
+	}
+
+	for _, candidate := range candidates {
+		if candidate != l.root && !strings.HasPrefix(candidate, l.root+string(filepath.Separator)) {
+			continue
+		}
+
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	if l.current != "" {
+		return "", fmt.Errorf("template '%s' not found (referenced from %s)", name, l.relative(l.current))
+	}
+	return "", fmt.Errorf("template '%s' not found", name)
+}
+
+func (l *webrootLoader) Read(name string) (io.Reader, error) {
+	path, err := l.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l.deps.add(l.relative(path))
+
+	if isPagePath(path) {
+		_, body, err := splitFrontMatter(string(content))
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(body), nil
+	}
+
+	return bytes.NewReader(content), nil
+}
+
+func (l *webrootLoader) Inherit(from string) (loaders.Loader, error) {
+	if from == "" {
+		return &webrootLoader{root: l.root, current: l.current, deps: l.deps}, nil
+	}
+
+	path, err := l.Resolve(from)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webrootLoader{root: l.root, current: path, deps: l.deps}, nil
+}
+
+// loadTemplate parses a template from the webroot, and records the files it depends on
+func (app *App) loadTemplate(name string) (*exec.Template, []string, error) {
+	loader, err := newWebrootLoader(app.Config.WebRoot)
+	if err != nil {
+		return nil, nil, err
+	}
+	loader.current = filepath.Join(loader.root, name)
+
+	template, err := exec.NewTemplate(name, gonja.DefaultConfig, loader, gonja.DefaultEnvironment)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return template, loader.deps.list(), nil
+}
+
+// reloadTemplates re-parses only the templates affected by the changed files.
+// It returns false if some of the files aren't known templates or template
+// dependencies, in which case the routes need to be reloaded instead.
+func (app *App) reloadTemplates(changed []string) bool {
+	// Reloads are serialized, so a route reload can't be overwritten by the
+	// templates of the table it replaced
+	app.reloadMu.Lock()
+	defer app.reloadMu.Unlock()
+
+	deps := app.currentRoutes().tplDeps
+
+	affected := make(map[string]bool)
+	for _, path := range changed {
+		rel, err := filepath.Rel(app.Config.WebRoot, path)
+		if err != nil {
+			return false
+		}
+		rel = filepath.ToSlash(rel)
+
+		// The front matter of a page decides its queries, so pages need a full reload
+		if isPagePath(rel) {
+			return false
+		}
+
+		found := false
+		for name, files := range deps {
+			for _, file := range files {
+				if file == rel {
+					affected[name] = true
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	// Templates are parsed before taking the lock, so requests aren't held up
+	reloaded := make(map[string]*exec.Template)
+	reloadedDeps := make(map[string][]string)
+	for name := range affected {
+		template, files, err := app.loadTemplate(name)
+		if err != nil {
+			log.Printf("Error loading template %s: %v", name, err)
+			continue
+		}
+
+		reloaded[name] = template
+		reloadedDeps[name] = files
+		log.Println("Reloaded template ", name)
+	}
+
+	app.mu.Lock()
+	routes := app.routes.withTemplates()
+	for name := range affected {
+		if template, ok := reloaded[name]; ok {
+			routes.tpl[name] = template
+			routes.tplDeps[name] = reloadedDeps[name]
+		} else {
+			delete(routes.tpl, name)
+			delete(routes.tplDeps, name)
+		}
+	}
+	app.routes = routes
+	app.mu.Unlock()
+
+	return true
+}
+
+// conventionTemplate finds the template named after a route file, so that
+// users/{id}.get.sql renders users/{id}.get.tpl.html, or users/{id}.tpl.html
+func (routes *routeTable) conventionTemplate(routeFile string) (string, bool) {
+	base := strings.TrimSuffix(routeFile, ".sql")
+	candidates := []string{base + ".tpl.html"}
+
+	if methodExt := filepath.Ext(base); methodExt != "" {
+		candidates = append(candidates, strings.TrimSuffix(base, methodExt)+".tpl.html")
+	}
+
+	for _, candidate := range candidates {
+		if _, ok := routes.tpl[candidate]; ok {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// acceptsHTML reports whether the client asked for HTML in its Accept header.
+// Wildcards aren't enough, so API clients sending */* still get JSON.
+func acceptsHTML(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+			continue
+		}
+
+		// Media types with q=0 are explicitly not acceptable
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.TrimSpace(key) == "q" {
+				if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
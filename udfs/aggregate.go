@@ -0,0 +1,358 @@
+package udfs
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"modernc.org/sqlite"
+)
+
+// orderedCounts keeps values in the order they were first added, with how many
+// times they were added, so window functions can remove them again
+type orderedCounts struct {
+	order  []string
+	counts map[string]int
+}
+
+func (o *orderedCounts) add(value string) {
+	if o.counts == nil {
+		o.counts = make(map[string]int)
+	}
+	if o.counts[value] == 0 {
+		o.order = append(o.order, value)
+	}
+	o.counts[value]++
+}
+
+func (o *orderedCounts) remove(value string) {
+	if o.counts[value] == 0 {
+		return
+	}
+	o.counts[value]--
+	if o.counts[value] == 0 {
+		delete(o.counts, value)
+		o.order = slices.DeleteFunc(o.order, func(v string) bool { return v == value })
+	}
+}
+
+// numberArg reads a numeric argument of an aggregate. NULLs and text that
+// isn't a number are skipped, like SQLite's own aggregates skip NULLs.
+func numberArg(value driver.Value) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// numberValue returns a float as an integer if it's a whole number
+func numberValue(f float64) driver.Value {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f)
+	}
+	return f
+}
+
+// numbers collects the numbers of an aggregate
+type numbers struct {
+	values []float64
+}
+
+func (n *numbers) add(value driver.Value) {
+	if f, ok := numberArg(value); ok {
+		n.values = append(n.values, f)
+	}
+}
+
+func (n *numbers) remove(value driver.Value) {
+	if f, ok := numberArg(value); ok {
+		if i := slices.Index(n.values, f); i >= 0 {
+			n.values = slices.Delete(n.values, i, i+1)
+		}
+	}
+}
+
+func (n *numbers) sorted() []float64 {
+	sorted := slices.Clone(n.values)
+	slices.Sort(sorted)
+	return sorted
+}
+
+// percentileOf interpolates the pth percentile (0-100) of sorted numbers
+func percentileOf(sorted []float64, p float64) driver.Value {
+	if len(sorted) == 0 {
+		return nil
+	}
+
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// median is the median(x) aggregate
+type median struct {
+	numbers
+}
+
+func (m *median) Step(_ *sqlite.FunctionContext, args []driver.Value) error {
+	m.add(args[0])
+	return nil
+}
+
+func (m *median) WindowInverse(_ *sqlite.FunctionContext, args []driver.Value) error {
+	m.remove(args[0])
+	return nil
+}
+
+func (m *median) WindowValue(_ *sqlite.FunctionContext) (driver.Value, error) {
+	return percentileOf(m.sorted(), 50), nil
+}
+
+func (m *median) Final(_ *sqlite.FunctionContext) {}
+
+// percentile is the percentile(x, p) aggregate, with p from 0 to 100
+type percentile struct {
+	numbers
+	p float64
+}
+
+func (a *percentile) Step(_ *sqlite.FunctionContext, args []driver.Value) error {
+	p, ok := numberArg(args[1])
+	if !ok || p < 0 || p > 100 {
+		return fmt.Errorf("percentile must be a number from 0 to 100, got %v", args[1])
+	}
+	a.p = p
+	a.add(args[0])
+	return nil
+}
+
+func (a *percentile) WindowInverse(_ *sqlite.FunctionContext, args []driver.Value) error {
+	a.remove(args[0])
+	return nil
+}
+
+func (a *percentile) WindowValue(_ *sqlite.FunctionContext) (driver.Value, error) {
+	return percentileOf(a.sorted(), a.p), nil
+}
+
+func (a *percentile) Final(_ *sqlite.FunctionContext) {}
+
+// stringAggDistinct is the string_agg_distinct(x, [sep]) aggregate, which joins
+// the distinct values in the order they first appear
+type stringAggDistinct struct {
+	values    orderedCounts
+	separator string
+}
+
+func (a *stringAggDistinct) Step(_ *sqlite.FunctionContext, args []driver.Value) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("string_agg_distinct requires 1 or 2 arguments: value, [separator]")
+	}
+
+	a.separator = ","
+	if len(args) > 1 {
+		separator, err := textArg("separator", args[1])
+		if err != nil {
+			return err
+		}
+		a.separator = separator
+	}
+
+	if args[0] != nil {
+		a.values.add(fmt.Sprint(textValue(args[0])))
+	}
+	return nil
+}
+
+func (a *stringAggDistinct) WindowInverse(_ *sqlite.FunctionContext, args []driver.Value) error {
+	if args[0] != nil {
+		a.values.remove(fmt.Sprint(textValue(args[0])))
+	}
+	return nil
+}
+
+func (a *stringAggDistinct) WindowValue(_ *sqlite.FunctionContext) (driver.Value, error) {
+	if len(a.values.order) == 0 {
+		return nil, nil
+	}
+	return strings.Join(a.values.order, a.separator), nil
+}
+
+func (a *stringAggDistinct) Final(_ *sqlite.FunctionContext) {}
+
+// textValue returns blobs as text, so they're joined as text and not as byte slices
+func textValue(value driver.Value) driver.Value {
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return value
+}
+
+// jsonGroupObjectAgg is the json_group_object_agg(key, value) aggregate. Unlike
+// json_group_object, a key appearing again replaces its value, NULL keys are
+// skipped, and text holding a JSON object or array is embedded as JSON.
+type jsonGroupObjectAgg struct {
+	keys   orderedCounts
+	values map[string][]driver.Value
+}
+
+func (a *jsonGroupObjectAgg) Step(_ *sqlite.FunctionContext, args []driver.Value) error {
+	if args[0] == nil {
+		return nil
+	}
+
+	key := fmt.Sprint(textValue(args[0]))
+	if a.values == nil {
+		a.values = make(map[string][]driver.Value)
+	}
+	a.keys.add(key)
+	a.values[key] = append(a.values[key], textValue(args[1]))
+	return nil
+}
+
+func (a *jsonGroupObjectAgg) WindowInverse(_ *sqlite.FunctionContext, args []driver.Value) error {
+	if args[0] == nil {
+		return nil
+	}
+
+	key := fmt.Sprint(textValue(args[0]))
+	if values := a.values[key]; len(values) > 0 {
+		a.values[key] = values[1:]
+	}
+	a.keys.remove(key)
+	return nil
+}
+
+func (a *jsonGroupObjectAgg) WindowValue(_ *sqlite.FunctionContext) (driver.Value, error) {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, key := range a.keys.order {
+		values := a.values[key]
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		encodedValue, err := jsonAggValue(values[len(values)-1])
+		if err != nil {
+			return nil, err
+		}
+
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.Write(encodedKey)
+		b.WriteString(":")
+		b.Write(encodedValue)
+	}
+	b.WriteString("}")
+	return b.String(), nil
+}
+
+func (a *jsonGroupObjectAgg) Final(_ *sqlite.FunctionContext) {}
+
+// jsonAggValue encodes a value of json_group_object_agg, keeping JSON objects and arrays as they are
+func jsonAggValue(value driver.Value) ([]byte, error) {
+	if s, ok := value.(string); ok {
+		trimmed := strings.TrimSpace(s)
+		if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+			return []byte(trimmed), nil
+		}
+	}
+	return json.Marshal(value)
+}
+
+// histogram is the histogram(x, buckets) aggregate. buckets is either a number of
+// equal width buckets between the smallest and largest value, or a JSON array of
+// bucket edges. It returns a JSON array of {"from", "to", "count"} objects.
+type histogram struct {
+	numbers
+	buckets driver.Value
+}
+
+func (h *histogram) Step(_ *sqlite.FunctionContext, args []driver.Value) error {
+	h.buckets = args[1]
+	h.add(args[0])
+	return nil
+}
+
+func (h *histogram) WindowInverse(_ *sqlite.FunctionContext, args []driver.Value) error {
+	h.remove(args[0])
+	return nil
+}
+
+func (h *histogram) WindowValue(_ *sqlite.FunctionContext) (driver.Value, error) {
+	sorted := h.sorted()
+
+	var edges []float64
+	switch buckets := h.buckets.(type) {
+	case int64:
+		if buckets <= 0 {
+			return nil, fmt.Errorf("histogram needs at least 1 bucket, got %d", buckets)
+		}
+		if len(sorted) == 0 {
+			return "[]", nil
+		}
+
+		low, high := sorted[0], sorted[len(sorted)-1]
+		if low == high {
+			buckets = 1
+		}
+		for i := int64(0); i <= buckets; i++ {
+			edges = append(edges, low+(high-low)*float64(i)/float64(buckets))
+		}
+		edges[len(edges)-1] = high
+	case string:
+		if err := json.Unmarshal([]byte(buckets), &edges); err != nil || len(edges) < 2 {
+			return nil, fmt.Errorf("histogram buckets must be a number or a JSON array of at least 2 edges")
+		}
+		if !slices.IsSorted(edges) {
+			return nil, fmt.Errorf("histogram bucket edges must be in ascending order")
+		}
+	default:
+		return nil, fmt.Errorf("histogram buckets must be a number or a JSON array of edges, got %T", h.buckets)
+	}
+
+	type bucket struct {
+		From  driver.Value `json:"from"`
+		To    driver.Value `json:"to"`
+		Count int          `json:"count"`
+	}
+
+	// Buckets include their lower edge, and the last one its upper edge too
+	result := make([]bucket, len(edges)-1)
+	for i := range result {
+		result[i] = bucket{From: numberValue(edges[i]), To: numberValue(edges[i+1])}
+	}
+	for _, value := range sorted {
+		if value < edges[0] || value > edges[len(edges)-1] {
+			continue
+		}
+		i, _ := slices.BinarySearch(edges, value)
+		if i == len(edges) || edges[i] != value {
+			i--
+		}
+		result[min(i, len(result)-1)].Count++
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+func (h *histogram) Final(_ *sqlite.FunctionContext) {}
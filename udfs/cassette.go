@@ -0,0 +1,189 @@
+package udfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Cassette modes: record every response, replay recorded responses only,
+// or replay the responses that were recorded and record the others
+const (
+	CassetteRecord = "record"
+	CassetteReplay = "replay"
+	CassetteAuto   = "auto"
+)
+
+// cassetteNameRegex matches the characters that can't be used in cassette file names
+var cassetteNameRegex = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// cassetteTransport records the responses of outbound requests to a directory of JSON
+// files, and replays them, so routes calling external APIs can be tested offline
+type cassetteTransport struct {
+	dir          string
+	mode         string
+	maxBodyBytes int64
+	next         http.RoundTripper
+}
+
+// cassette is a recorded request and its response
+type cassette struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Body   string `json:"body,omitempty"`
+	} `json:"request"`
+	Response struct {
+		StatusCode int         `json:"status_code"`
+		Status     string      `json:"status"`
+		Headers    http.Header `json:"headers"`
+		Body       string      `json:"body"`
+		Base64     bool        `json:"base64,omitempty"`
+	} `json:"response"`
+}
+
+// newCassetteTransport checks the mode and creates the directory of the cassettes.
+// Responses larger than maxBodyBytes aren't recorded.
+func newCassetteTransport(dir, mode string, maxBodyBytes int64, next http.RoundTripper) (*cassetteTransport, error) {
+	switch mode {
+	case CassetteRecord, CassetteReplay, CassetteAuto:
+	default:
+		return nil, fmt.Errorf("unknown cassette mode '%s', expected record, replay or auto", mode)
+	}
+
+	if mode != CassetteReplay {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("error creating cassette directory %s: %v", dir, err)
+		}
+	}
+
+	return &cassetteTransport{dir: dir, mode: mode, maxBodyBytes: maxBodyBytes, next: next}, nil
+}
+
+// RoundTrip replays the recorded response to a request, or records a new one
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	path := filepath.Join(t.dir, cassetteName(req, body))
+
+	if t.mode != CassetteRecord {
+		recorded, err := os.ReadFile(path)
+		if err == nil {
+			return replayCassette(req, recorded, path)
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if t.mode == CassetteReplay {
+			return nil, fmt.Errorf("no recorded response for %s %s in %s", req.Method, req.URL, path)
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// The whole body is recorded, so it can't be larger than a response may be
+	limit := t.maxBodyBytes
+	if limit <= 0 {
+		limit = 10 << 20
+	}
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(respBody)) > limit {
+		return nil, fmt.Errorf("response body is larger than %d bytes, too large to record", limit)
+	}
+
+	var c cassette
+	c.Request.Method = req.Method
+	c.Request.URL = req.URL.String()
+	c.Request.Body = string(body)
+	c.Response.StatusCode = resp.StatusCode
+	c.Response.Status = resp.Status
+	c.Response.Headers = resp.Header
+	c.Response.Body = string(respBody)
+	if !utf8.Valid(respBody) {
+		c.Response.Body = base64.StdEncoding.EncodeToString(respBody)
+		c.Response.Base64 = true
+	}
+
+	recorded, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, append(recorded, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("error recording cassette %s: %v", path, err)
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+	return resp, nil
+}
+
+// cassetteName names the file of a request after its method and host, and a hash
+// of its method, URL and body. Headers aren't part of the name, so credentials
+// can change without recording again.
+func cassetteName(req *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL)
+	h.Write(body)
+
+	host := strings.Trim(cassetteNameRegex.ReplaceAllString(req.URL.Host, "_"), "_")
+	return fmt.Sprintf("%s-%s-%s.json", strings.ToLower(req.Method), host, hex.EncodeToString(h.Sum(nil))[:16])
+}
+
+// replayCassette builds the response to a request from a recorded cassette
+func replayCassette(req *http.Request, recorded []byte, path string) (*http.Response, error) {
+	var c cassette
+	if err := json.Unmarshal(recorded, &c); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %v", path, err)
+	}
+
+	body := []byte(c.Response.Body)
+	if c.Response.Base64 {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(c.Response.Body); err != nil {
+			return nil, fmt.Errorf("invalid cassette body in %s: %v", path, err)
+		}
+	}
+
+	header := c.Response.Headers
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        c.Response.Status,
+		StatusCode:    c.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,40 @@
+package udfs
+
+import (
+	"context"
+	"database/sql/driver"
+	"sort"
+)
+
+// FunctionInfo describes a registered function, for the wtf_functions table function
+type FunctionInfo struct {
+	Name          string
+	Type          string
+	NArgs         int32
+	Deterministic bool
+}
+
+// catalog lists the functions registered by RegisterUdfs
+var catalog []FunctionInfo
+
+// Catalog returns every function registered by RegisterUdfs, sorted by name
+func Catalog() []FunctionInfo {
+	functions := append([]FunctionInfo{}, catalog...)
+	sort.Slice(functions, func(i, j int) bool { return functions[i].Name < functions[j].Name })
+	return functions
+}
+
+// wtfFunctions lists the functions wtfhttpd provides, with their type (scalar,
+// aggregate or table), number of arguments (-1 if it varies) and whether
+// they're deterministic. Usage: SELECT * FROM wtf_functions
+func wtfFunctions(_ context.Context, _ []driver.Value) ([][]driver.Value, error) {
+	var rows [][]driver.Value
+	for _, fn := range Catalog() {
+		deterministic := int64(0)
+		if fn.Deterministic {
+			deterministic = 1
+		}
+		rows = append(rows, []driver.Value{fn.Name, fn.Type, int64(fn.NArgs), deterministic})
+	}
+	return rows, nil
+}
@@ -0,0 +1,420 @@
+package udfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"modernc.org/sqlite"
+)
+
+// Crypto holds the key the encrypt and decrypt functions use
+type Crypto struct {
+	aead cipher.AEAD
+}
+
+// NewCrypto derives an AES-256-GCM key from a secret. Without a secret,
+// encrypt and decrypt report an error when they're called.
+func NewCrypto(secret string) (*Crypto, error) {
+	if secret == "" {
+		return &Crypto{}, nil
+	}
+
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, "wtfhttpd encrypt", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Crypto{aead: aead}, nil
+}
+
+// bytesArg reads an argument that is hashed, signed or encrypted. Text and blobs
+// are used as they are, numbers as their text.
+func bytesArg(name string, value driver.Value) ([]byte, error) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case int64, float64:
+		return []byte(fmt.Sprint(v)), nil
+	}
+	return nil, fmt.Errorf("%s must be text, got %T", name, value)
+}
+
+// decodeBinary decodes a key or signature of the given size, written as hex or base64
+func decodeBinary(name, s string, sizes ...int) ([]byte, error) {
+	for _, size := range sizes {
+		if len(s) == hex.EncodedLen(size) {
+			if b, err := hex.DecodeString(s); err == nil {
+				return b, nil
+			}
+		}
+	}
+
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := encoding.DecodeString(s); err == nil {
+			for _, size := range sizes {
+				if len(b) == size {
+					return b, nil
+				}
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("%s must be hex or base64 encoded, and %d bytes long", name, sizes[0])
+}
+
+// digest hashes its argument, returning the hash as hex or base64
+func digest(name string, newHash func() hash.Hash, encode func([]byte) string) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s supports 1 argument, got %d", name, len(args))
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+
+		input, err := bytesArg(name+" argument", args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		h := newHash()
+		h.Write(input)
+		return encode(h.Sum(nil)), nil
+	}
+}
+
+// hmacDigest signs a message with a key, returning the HMAC as hex or base64
+func hmacDigest(name string, newHash func() hash.Hash, encode func([]byte) string) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s supports 2 arguments, got %d", name, len(args))
+		}
+
+		key, err := bytesArg(name+" key", args[0])
+		if err != nil {
+			return nil, err
+		}
+		message, err := bytesArg(name+" message", args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		mac := hmac.New(newHash, key)
+		mac.Write(message)
+		return encode(mac.Sum(nil)), nil
+	}
+}
+
+// secureCompare compares two values in constant time, so comparing secrets
+// like signatures doesn't leak how much of them matched
+func secureCompare(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("secure_compare supports 2 arguments, got %d", len(args))
+	}
+	if args[0] == nil || args[1] == nil {
+		return int64(0), nil
+	}
+
+	a, err := bytesArg("secure_compare first argument", args[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := bytesArg("secure_compare second argument", args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return int64(subtle.ConstantTimeCompare(a, b)), nil
+}
+
+// The argon2id parameters recommended by RFC 9106 for memory constrained environments
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+// The largest argon2id parameters argon2id_verify accepts, so a hash can't make it
+// use more than 256 MiB of memory or take much longer than one made by argon2id_hash
+const (
+	argon2MaxTime    = 10
+	argon2MaxMemory  = 256 * 1024
+	argon2MaxThreads = 16
+	argon2MaxKeyLen  = 64
+)
+
+// argon2idHash hashes a password with argon2id, in the $argon2id$v=19$m=...,t=...,p=...$salt$hash format
+func argon2idHash(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("argon2id_hash supports 1 argument, got %d", len(args))
+	}
+
+	password, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("argon2id_hash argument must be a string, got %T", args[0])
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// argon2idVerify checks a password against an argon2id hash, using the parameters in the hash
+func argon2idVerify(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("argon2id_verify supports 2 arguments, got %d", len(args))
+	}
+
+	password, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("argon2id_verify first argument must be a string, got %T", args[0])
+	}
+
+	encoded, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("argon2id_verify second argument must be a string, got %T", args[1])
+	}
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("argon2id_verify error: not an argon2id hash")
+	}
+
+	var version int
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("argon2id_verify error: unsupported version %s", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time < 1 || threads < 1 {
+		return nil, fmt.Errorf("argon2id_verify error: invalid parameters %s", parts[3])
+	}
+	if memory > argon2MaxMemory || time > argon2MaxTime || threads > argon2MaxThreads {
+		return nil, fmt.Errorf("argon2id_verify error: parameters %s are over the limit of m=%d,t=%d,p=%d",
+			parts[3], argon2MaxMemory, argon2MaxTime, argon2MaxThreads)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("argon2id_verify error: invalid salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, fmt.Errorf("argon2id_verify error: invalid hash: %v", err)
+	}
+	if len(key) == 0 || len(key) > argon2MaxKeyLen {
+		return nil, fmt.Errorf("argon2id_verify error: hash must be from 1 to %d bytes, got %d", argon2MaxKeyLen, len(key))
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return int64(subtle.ConstantTimeCompare(key, candidate)), nil
+}
+
+// encrypt encrypts text with AES-GCM, keyed from the configured secret, and returns
+// the nonce and ciphertext as URL safe base64, so it can be stored in cookies.
+// Usage: encrypt(plaintext, [associated_data])
+func encrypt(c *Crypto) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("encrypt supports 1 or 2 arguments, got %d", len(args))
+		}
+		if c.aead == nil {
+			return nil, fmt.Errorf("encrypt requires secret_key to be set in wtf.toml")
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+
+		plaintext, err := bytesArg("encrypt plaintext", args[0])
+		if err != nil {
+			return nil, err
+		}
+		var additional []byte
+		if len(args) == 2 && args[1] != nil {
+			if additional, err = bytesArg("encrypt associated data", args[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		nonce := make([]byte, c.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %v", err)
+		}
+
+		sealed := c.aead.Seal(nonce, nonce, plaintext, additional)
+		return base64.RawURLEncoding.EncodeToString(sealed), nil
+	}
+}
+
+// decrypt decrypts the output of encrypt. It returns NULL if the ciphertext
+// was tampered with, or encrypted with another key or associated data.
+// Usage: decrypt(ciphertext, [associated_data])
+func decrypt(c *Crypto) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("decrypt supports 1 or 2 arguments, got %d", len(args))
+		}
+		if c.aead == nil {
+			return nil, fmt.Errorf("decrypt requires secret_key to be set in wtf.toml")
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+
+		ciphertext, err := textArg("decrypt ciphertext", args[0])
+		if err != nil {
+			return nil, err
+		}
+		var additional []byte
+		if len(args) == 2 && args[1] != nil {
+			if additional, err = bytesArg("decrypt associated data", args[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		sealed, err := base64.RawURLEncoding.DecodeString(ciphertext)
+		if err != nil || len(sealed) < c.aead.NonceSize() {
+			return nil, nil
+		}
+
+		nonce, sealed := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+		plaintext, err := c.aead.Open(nil, nonce, sealed, additional)
+		if err != nil {
+			return nil, nil
+		}
+		return string(plaintext), nil
+	}
+}
+
+// ed25519Keygen generates an Ed25519 key pair, returned as a JSON object
+// with the base64 encoded public_key and private_key
+func ed25519Keygen(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("ed25519_keygen supports 0 arguments, got %d", len(args))
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("ed25519_keygen error: %v", err)
+	}
+
+	encoded, err := json.Marshal(map[string]string{
+		"public_key":  base64.StdEncoding.EncodeToString(public),
+		"private_key": base64.StdEncoding.EncodeToString(private.Seed()),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+// ed25519Sign signs a message with a private key, given as its 32 byte seed or the
+// full 64 byte key, returning the signature as hex or base64
+func ed25519Sign(name string, encode func([]byte) string) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("%s supports 2 arguments, got %d", name, len(args))
+		}
+
+		encodedKey, err := textArg(name+" private key", args[0])
+		if err != nil {
+			return nil, err
+		}
+		key, err := decodeBinary(name+" private key", encodedKey, ed25519.SeedSize, ed25519.PrivateKeySize)
+		if err != nil {
+			return nil, err
+		}
+		message, err := bytesArg(name+" message", args[1])
+		if err != nil {
+			return nil, err
+		}
+
+		private := ed25519.PrivateKey(key)
+		if len(key) == ed25519.SeedSize {
+			private = ed25519.NewKeyFromSeed(key)
+		}
+		return encode(ed25519.Sign(private, message)), nil
+	}
+}
+
+// ed25519Verify checks the signature of a message with a public key. Keys and
+// signatures can be hex or base64 encoded.
+// Usage: ed25519_verify(public_key, message, signature)
+func ed25519Verify(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("ed25519_verify supports 3 arguments, got %d", len(args))
+	}
+
+	encodedKey, err := textArg("ed25519_verify public key", args[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeBinary("ed25519_verify public key", encodedKey, ed25519.PublicKeySize)
+	if err != nil {
+		return nil, err
+	}
+	message, err := bytesArg("ed25519_verify message", args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	encodedSignature, err := textArg("ed25519_verify signature", args[2])
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decodeBinary("ed25519_verify signature", encodedSignature, ed25519.SignatureSize)
+	if err != nil {
+		return int64(0), nil
+	}
+
+	if ed25519.Verify(ed25519.PublicKey(key), message, signature) {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+// The hash and HMAC functions, with hex and base64 variants
+var (
+	sha256Hex        = digest("sha256", sha256.New, hex.EncodeToString)
+	sha256Base64     = digest("sha256_base64", sha256.New, base64.StdEncoding.EncodeToString)
+	sha512Hex        = digest("sha512", sha512.New, hex.EncodeToString)
+	sha512Base64     = digest("sha512_base64", sha512.New, base64.StdEncoding.EncodeToString)
+	hmacSHA256Hex    = hmacDigest("hmac_sha256", sha256.New, hex.EncodeToString)
+	hmacSHA256Base64 = hmacDigest("hmac_sha256_base64", sha256.New, base64.StdEncoding.EncodeToString)
+	hmacSHA512Hex    = hmacDigest("hmac_sha512", sha512.New, hex.EncodeToString)
+	hmacSHA512Base64 = hmacDigest("hmac_sha512_base64", sha512.New, base64.StdEncoding.EncodeToString)
+	ed25519SignHex   = ed25519Sign("ed25519_sign_hex", hex.EncodeToString)
+	ed25519SignB64   = ed25519Sign("ed25519_sign", base64.StdEncoding.EncodeToString)
+)
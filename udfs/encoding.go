@@ -0,0 +1,131 @@
+package udfs
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"net/url"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"modernc.org/sqlite"
+)
+
+// base64Encode encodes text or a blob as standard base64
+func base64Encode(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("base64_encode supports 1 argument, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	input, err := bytesArg("base64_encode argument", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.EncodeToString(input), nil
+}
+
+// base64Decode decodes standard or URL safe base64, with or without padding.
+// It returns text, or a blob if the decoded bytes aren't valid UTF-8.
+func base64Decode(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("base64_decode supports 1 argument, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	input, err := textArg("base64_decode argument", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(input); err == nil {
+			if utf8.Valid(decoded) {
+				return string(decoded), nil
+			}
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("base64_decode argument is not valid base64")
+}
+
+// urlEncode escapes text for use in a URL query string
+func urlEncode(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("url_encode supports 1 argument, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	input, err := bytesArg("url_encode argument", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return url.QueryEscape(string(input)), nil
+}
+
+// urlDecode reverses url_encode, decoding %XX escapes and + as a space
+func urlDecode(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("url_decode supports 1 argument, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	input, err := textArg("url_decode argument", args[0])
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := url.QueryUnescape(input)
+	if err != nil {
+		return nil, fmt.Errorf("url_decode error: %v", err)
+	}
+	return decoded, nil
+}
+
+// htmlEscape escapes <, >, &, ' and " so text can be put in HTML
+func htmlEscape(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("html_escape supports 1 argument, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	input, err := bytesArg("html_escape argument", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return html.EscapeString(string(input)), nil
+}
+
+// markdownToHTML renders markdown with the same settings as content files
+func markdownToHTML(md goldmark.Markdown) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("markdown_to_html supports 1 argument, got %d", len(args))
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+
+		source, err := textArg("markdown_to_html argument", args[0])
+		if err != nil {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := md.Convert([]byte(source), &buf); err != nil {
+			return nil, fmt.Errorf("markdown_to_html error: %v", err)
+		}
+		return buf.String(), nil
+	}
+}
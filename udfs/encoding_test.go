@@ -0,0 +1,102 @@
+package udfs
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+func TestBase64RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input driver.Value
+		want  driver.Value
+	}{
+		{"text", "hello, world", "hello, world"},
+		{"empty", "", ""},
+		{"unicode", "héllo wörld ✓", "héllo wörld ✓"},
+		{"text blob", []byte("hello"), "hello"},
+		{"binary blob", []byte{0xff, 0x00, 0xfe}, []byte{0xff, 0x00, 0xfe}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := base64Encode(nil, []driver.Value{tt.input})
+			if err != nil {
+				t.Fatalf("base64_encode error: %v", err)
+			}
+			decoded, err := base64Decode(nil, []driver.Value{encoded})
+			if err != nil {
+				t.Fatalf("base64_decode error: %v", err)
+			}
+			if !sameValue(decoded, tt.want) {
+				t.Errorf("base64_decode(base64_encode(%v)) = %#v, want %#v", tt.input, decoded, tt.want)
+			}
+		})
+	}
+}
+
+func TestBase64DecodeVariants(t *testing.T) {
+	tests := []struct {
+		input string
+		want  driver.Value
+	}{
+		{"aGk/Pz4+", "hi??>>"},
+		{"aGk_Pz4-", "hi??>>"},
+		{"aGk", "hi"},
+		{"aGk=", "hi"},
+	}
+
+	for _, tt := range tests {
+		got, err := base64Decode(nil, []driver.Value{tt.input})
+		if err != nil {
+			t.Errorf("base64_decode(%q) error: %v", tt.input, err)
+			continue
+		}
+		if !sameValue(got, tt.want) {
+			t.Errorf("base64_decode(%q) = %#v, want %#v", tt.input, got, tt.want)
+		}
+	}
+
+	if _, err := base64Decode(nil, []driver.Value{"not base64!"}); err == nil {
+		t.Error("base64_decode of invalid base64 didn't fail")
+	}
+}
+
+func TestURLRoundTrip(t *testing.T) {
+	tests := []struct {
+		input   string
+		encoded string
+	}{
+		{"plain", "plain"},
+		{"a b&c=d", "a+b%26c%3Dd"},
+		{"ünïcode/?#", "%C3%BCn%C3%AFcode%2F%3F%23"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		encoded, err := urlEncode(nil, []driver.Value{tt.input})
+		if err != nil {
+			t.Fatalf("url_encode(%q) error: %v", tt.input, err)
+		}
+		if encoded != tt.encoded {
+			t.Errorf("url_encode(%q) = %q, want %q", tt.input, encoded, tt.encoded)
+		}
+
+		decoded, err := urlDecode(nil, []driver.Value{encoded})
+		if err != nil {
+			t.Fatalf("url_decode(%q) error: %v", encoded, err)
+		}
+		if decoded != tt.input {
+			t.Errorf("url_decode(url_encode(%q)) = %q", tt.input, decoded)
+		}
+	}
+}
+
+// sameValue compares function results, which can be blobs
+func sameValue(a, b driver.Value) bool {
+	if a, ok := a.([]byte); ok {
+		b, ok := b.([]byte)
+		return ok && string(a) == string(b)
+	}
+	return a == b
+}
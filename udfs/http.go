@@ -2,106 +2,589 @@ package udfs
 
 import (
 	"bytes"
+	"context"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"modernc.org/sqlite"
 )
 
-// httpGet implements the http_get function for SQLite
-func httpGet(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
-	if len(args) != 1 && len(args) != 2 {
-		return nil, fmt.Errorf("http_get supports 1 or 2 arguments, got %d", len(args))
+// HTTPConfig holds the limits of the http_* functions
+type HTTPConfig struct {
+	Timeout         time.Duration
+	MaxBodyBytes    int64
+	FollowRedirects bool
+	MaxRedirects    int
+	AllowHosts      []string
+	DenyHosts       []string
+	BlockPrivate    bool
+
+	// CacheDB is the SQLite database of the HTTP cache, which is off if it's empty
+	CacheDB string
+	// CassetteDir and CassetteMode record or replay the responses of outbound requests
+	CassetteDir  string
+	CassetteMode string
+}
+
+// HTTPStats are the statistics of the requests made by the http_* functions
+type HTTPStats struct {
+	Requests   int64
+	Failures   int64
+	Blocked    int64
+	CacheHits  int64
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+}
+
+// HTTPClient is the client shared by the http_* functions. It pools connections,
+// enforces the configured limits and keeps statistics of the outbound requests.
+type HTTPClient struct {
+	config HTTPConfig
+	client *http.Client
+	cache  *cachingTransport
+	allow  []hostRule
+	deny   []hostRule
+
+	requests     atomic.Int64
+	failures     atomic.Int64
+	blocked      atomic.Int64
+	completed    atomic.Int64
+	totalLatency atomic.Int64
+	maxLatency   atomic.Int64
+}
+
+// requestOptions are the per call options of the http_* functions
+type requestOptions struct {
+	timeout         time.Duration
+	maxBodyBytes    int64
+	followRedirects bool
+	noCache         bool
+}
+
+// requestOptionsKey carries the options of a request to the redirect policy
+type requestOptionsKey struct{}
+
+// blockedError is returned for requests to hosts that aren't allowed
+type blockedError struct {
+	host string
+}
+
+func (e *blockedError) Error() string {
+	return fmt.Sprintf("requests to %s are not allowed", e.host)
+}
+
+// hostRule is an entry of the allow and deny lists: a host name, a *.wildcard
+// matching its subdomains, or an IP range
+type hostRule struct {
+	pattern string
+	network *net.IPNet
+}
+
+// parseHostRules parses the entries of an allow or deny list
+func parseHostRules(entries []string) []hostRule {
+	var rules []hostRule
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			rules = append(rules, hostRule{network: network})
+		} else if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			rules = append(rules, hostRule{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}})
+		} else {
+			rules = append(rules, hostRule{pattern: entry})
+		}
+	}
+	return rules
+}
+
+// matchesHost reports whether a host name matches the rule
+func (r hostRule) matchesHost(host string) bool {
+	if r.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.network.Contains(ip)
 	}
+	if suffix, ok := strings.CutPrefix(r.pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == r.pattern
+}
 
-	return makeRequest("GET", args, nil)
+// privateNetworks are the ranges that aren't reachable from the internet, besides
+// the loopback, private and link local ranges net.IP knows about
+var privateNetworks = parseHostRules([]string{
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+})
+
+// isPrivateIP reports whether an address belongs to a private network, such as
+// localhost, the LAN or a cloud metadata service
+func isPrivateIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, rule := range privateNetworks {
+		if rule.network.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-// httpPost implements the http_post function for SQLite
-func httpPost(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
-	if len(args) < 1 || len(args) > 3 {
-		return nil, fmt.Errorf("http_post supports 1-3 arguments, got %d", len(args))
+// NewHTTPClient creates the client of the http_* functions. Responses go through
+// the cassette, if one is used, and the HTTP cache, if it's on.
+func NewHTTPClient(config HTTPConfig) (*HTTPClient, error) {
+	c := &HTTPClient{
+		config: config,
+		allow:  parseHostRules(config.AllowHosts),
+		deny:   parseHostRules(config.DenyHosts),
 	}
 
-	var body []byte
-	if len(args) >= 3 {
-		bodyStr, ok := args[2].(string)
-		if !ok {
-			return nil, fmt.Errorf("http_post body argument must be a string, got %T", args[2])
+	transport := &http.Transport{
+		DialContext:           c.dialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   10,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	var roundTripper http.RoundTripper = transport
+	if config.CassetteMode != "" {
+		cassette, err := newCassetteTransport(config.CassetteDir, config.CassetteMode, config.MaxBodyBytes, roundTripper)
+		if err != nil {
+			return nil, err
+		}
+		roundTripper = cassette
+	}
+
+	if config.CacheDB != "" {
+		cache, err := openHTTPCache(config.CacheDB, roundTripper, config.MaxBodyBytes)
+		if err != nil {
+			return nil, err
 		}
-		body = []byte(bodyStr)
+		c.cache = cache
+		roundTripper = cache
 	}
 
-	return makeRequest("POST", args, body)
+	c.client = &http.Client{
+		Transport:     roundTripper,
+		CheckRedirect: c.checkRedirect,
+	}
+
+	return c, nil
 }
 
-// httpPut implements the http_put function for SQLite
-func httpPut(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
-	if len(args) < 1 || len(args) > 3 {
-		return nil, fmt.Errorf("http_put supports 1-3 arguments, got %d", len(args))
+// Stats returns the statistics of the requests made so far
+func (c *HTTPClient) Stats() HTTPStats {
+	stats := HTTPStats{
+		Requests:   c.requests.Load(),
+		Failures:   c.failures.Load(),
+		Blocked:    c.blocked.Load(),
+		MaxLatency: time.Duration(c.maxLatency.Load()),
 	}
 
-	var body []byte
-	if len(args) >= 3 {
-		bodyStr, ok := args[2].(string)
-		if !ok {
-			return nil, fmt.Errorf("http_put body argument must be a string, got %T", args[2])
+	if c.cache != nil {
+		stats.CacheHits = c.cache.hits.Load()
+	}
+
+	if completed := c.completed.Load(); completed > 0 {
+		stats.AvgLatency = time.Duration(c.totalLatency.Load() / completed)
+	}
+	return stats
+}
+
+// checkHost applies the allow and deny lists to the host of a URL. IP addresses
+// and ranges on the allow list only allow URLs with an IP address as their host,
+// never host names that happen to resolve into them.
+func (c *HTTPClient) checkHost(host string) error {
+	host = strings.ToLower(host)
+
+	for _, rule := range c.deny {
+		if rule.matchesHost(host) {
+			return &blockedError{host: host}
+		}
+	}
+
+	if len(c.allow) == 0 {
+		return nil
+	}
+	for _, rule := range c.allow {
+		if rule.matchesHost(host) {
+			return nil
+		}
+	}
+	return &blockedError{host: host}
+}
+
+// checkIP applies the IP ranges of the deny list, and the private network blocking,
+// to an address a host resolved to. Hosts on the allow list may be private.
+func (c *HTTPClient) checkIP(host string, ip net.IP) error {
+	host = strings.ToLower(host)
+
+	for _, rule := range c.deny {
+		if rule.network != nil && rule.network.Contains(ip) {
+			return &blockedError{host: host}
+		}
+	}
+
+	allowed := false
+	for _, rule := range c.allow {
+		if rule.matchesHost(host) {
+			allowed = true
+			break
+		}
+	}
+
+	if len(c.allow) > 0 && !allowed {
+		return &blockedError{host: host}
+	}
+	if c.config.BlockPrivate && !allowed && isPrivateIP(ip) {
+		return &blockedError{host: host}
+	}
+	return nil
+}
+
+// dialContext resolves the host itself and checks every address before connecting,
+// so a host can't resolve to a blocked address between the check and the connection
+func (c *HTTPClient) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Connecting can't take longer than the whole request may
+	dialer := &net.Dialer{Timeout: c.config.Timeout, KeepAlive: 30 * time.Second}
+
+	var lastErr error
+	for _, a := range addrs {
+		if err := c.checkIP(host, a.IP); err != nil {
+			lastErr = err
+			continue
+		}
+
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(a.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %s", host)
+	}
+	return nil, lastErr
+}
+
+// checkRedirect follows redirects unless the call turned them off, and checks every
+// host along the way
+func (c *HTTPClient) checkRedirect(req *http.Request, via []*http.Request) error {
+	options, _ := req.Context().Value(requestOptionsKey{}).(requestOptions)
+	if !options.followRedirects {
+		return http.ErrUseLastResponse
+	}
+
+	if len(via) >= c.config.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", c.config.MaxRedirects)
+	}
+
+	return c.checkHost(req.URL.Hostname())
+}
+
+// parseOptions reads the options JSON of a call. The timeout and body size can
+// only be lowered from the configured limits.
+func (c *HTTPClient) parseOptions(value driver.Value) (requestOptions, error) {
+	options := requestOptions{
+		timeout:         c.config.Timeout,
+		maxBodyBytes:    c.config.MaxBodyBytes,
+		followRedirects: c.config.FollowRedirects,
+	}
+
+	optionsJSON, ok := value.(string)
+	if !ok {
+		return options, fmt.Errorf("options argument must be a string, got %T", value)
+	}
+	if optionsJSON == "" {
+		return options, nil
+	}
+
+	var parsed struct {
+		Timeout         any   `json:"timeout"`
+		MaxBytes        int64 `json:"max_bytes"`
+		FollowRedirects *bool `json:"follow_redirects"`
+		Cache           *bool `json:"cache"`
+	}
+	if err := json.Unmarshal([]byte(optionsJSON), &parsed); err != nil {
+		return options, fmt.Errorf("invalid options JSON: %v", err)
+	}
+
+	var timeout time.Duration
+	switch t := parsed.Timeout.(type) {
+	case nil:
+	case float64:
+		timeout = time.Duration(t * float64(time.Second))
+	case string:
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return options, fmt.Errorf("invalid timeout '%s': %v", t, err)
 		}
-		body = []byte(bodyStr)
+		timeout = d
+	default:
+		return options, fmt.Errorf("timeout must be a number of seconds or a duration string")
+	}
+
+	if timeout > 0 && (options.timeout <= 0 || timeout < options.timeout) {
+		options.timeout = timeout
+	}
+	if parsed.MaxBytes > 0 && (options.maxBodyBytes <= 0 || parsed.MaxBytes < options.maxBodyBytes) {
+		options.maxBodyBytes = parsed.MaxBytes
+	}
+	if parsed.FollowRedirects != nil {
+		options.followRedirects = *parsed.FollowRedirects
+	}
+	if parsed.Cache != nil {
+		options.noCache = !*parsed.Cache
 	}
 
-	return makeRequest("PUT", args, body)
+	return options, nil
+}
+
+// httpGet implements the http_get function for SQLite
+func httpGet(c *HTTPClient) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(fc *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 3 {
+			return nil, fmt.Errorf("http_get supports 1-3 arguments, got %d", len(args))
+		}
+
+		return c.makeRequest(requestContext(fc), "GET", args, nil, 2)
+	}
+}
+
+// httpPost implements the http_post function for SQLite
+func httpPost(c *HTTPClient) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return httpWithBody(c, "POST", "http_post")
+}
+
+// httpPut implements the http_put function for SQLite
+func httpPut(c *HTTPClient) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return httpWithBody(c, "PUT", "http_put")
 }
 
 // httpPatch implements the http_patch function for SQLite
-func httpPatch(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
-	if len(args) < 1 || len(args) > 3 {
-		return nil, fmt.Errorf("http_patch supports 1-3 arguments, got %d", len(args))
+func httpPatch(c *HTTPClient) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return httpWithBody(c, "PATCH", "http_patch")
+}
+
+// httpDelete implements the http_delete function for SQLite
+func httpDelete(c *HTTPClient) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(fc *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 3 {
+			return nil, fmt.Errorf("http_delete supports 1-3 arguments, got %d", len(args))
+		}
+
+		return c.makeRequest(requestContext(fc), "DELETE", args, nil, 2)
 	}
+}
+
+// httpGetRows makes a GET request and returns the elements of the JSON array in its
+// body as rows, like json_each. A path such as '$.data.items' selects a nested array.
+// Usage: SELECT value FROM wtf_http_get_rows(url, [headers_json], [path])
+func httpGetRows(c *HTTPClient) func(context.Context, []driver.Value) ([][]driver.Value, error) {
+	return func(ctx context.Context, args []driver.Value) ([][]driver.Value, error) {
+		result, err := c.makeRequest(ctx, "GET", args[:2], nil, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		var response struct {
+			StatusCode int     `json:"status_code"`
+			Status     string  `json:"status"`
+			Body       string  `json:"body"`
+			Error      *string `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(result.(string)), &response); err != nil {
+			return nil, err
+		}
+		if response.Error != nil {
+			return nil, errors.New(*response.Error)
+		}
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return nil, fmt.Errorf("GET %v returned %s", args[0], response.Status)
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(response.Body))
+		decoder.UseNumber()
+		var body any
+		if err := decoder.Decode(&body); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %v", err)
+		}
 
-	var body []byte
-	if len(args) >= 3 {
-		bodyStr, ok := args[2].(string)
+		if args[2] != nil {
+			path, err := textArg("path", args[2])
+			if err != nil {
+				return nil, err
+			}
+			if body, err = jsonPath(body, path); err != nil {
+				return nil, err
+			}
+		}
+
+		items, ok := body.([]any)
 		if !ok {
-			return nil, fmt.Errorf("http_patch body argument must be a string, got %T", args[2])
+			return nil, fmt.Errorf("the body is not a JSON array, use a path to select one")
 		}
-		body = []byte(bodyStr)
+
+		rows := make([][]driver.Value, len(items))
+		for i, item := range items {
+			value, kind, err := jsonRowValue(item)
+			if err != nil {
+				return nil, err
+			}
+			rows[i] = []driver.Value{int64(i), value, kind}
+		}
+		return rows, nil
 	}
+}
+
+// jsonPathRegex matches the steps of a path like $.data.items[0]
+var jsonPathRegex = regexp.MustCompile(`\.([^.\[\]]+)|\[(\d+)\]`)
 
-	return makeRequest("PATCH", args, body)
+// jsonPath selects a value from decoded JSON with a path of keys and array indexes
+func jsonPath(value any, path string) (any, error) {
+	rest, ok := strings.CutPrefix(path, "$")
+	if !ok {
+		return nil, fmt.Errorf("path must start with $, got '%s'", path)
+	}
+
+	for _, step := range jsonPathRegex.FindAllStringSubmatch(rest, -1) {
+		switch v := value.(type) {
+		case map[string]any:
+			if step[1] == "" {
+				return nil, fmt.Errorf("path '%s' indexes an object", path)
+			}
+			value = v[step[1]]
+		case []any:
+			index, err := strconv.Atoi(step[2])
+			if step[2] == "" || err != nil || index >= len(v) {
+				return nil, fmt.Errorf("path '%s' doesn't match the body", path)
+			}
+			value = v[index]
+		default:
+			return nil, fmt.Errorf("path '%s' doesn't match the body", path)
+		}
+	}
+	return value, nil
 }
 
-// httpDelete implements the http_delete function for SQLite
-func httpDelete(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
-	if len(args) != 1 && len(args) != 2 {
-		return nil, fmt.Errorf("http_delete supports 1 or 2 arguments, got %d", len(args))
+// jsonRowValue converts a decoded JSON value to a SQLite value and its json_each type.
+// Objects and arrays stay JSON text, so they can be queried with ->> and json_extract.
+func jsonRowValue(item any) (driver.Value, string, error) {
+	switch v := item.(type) {
+	case nil:
+		return nil, "null", nil
+	case bool:
+		if v {
+			return int64(1), "true", nil
+		}
+		return int64(0), "false", nil
+	case string:
+		return v, "text", nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, "integer", nil
+		}
+		f, err := v.Float64()
+		return f, "real", err
+	case []any:
+		encoded, err := json.Marshal(v)
+		return string(encoded), "array", err
 	}
+	encoded, err := json.Marshal(item)
+	return string(encoded), "object", err
+}
 
-	return makeRequest("DELETE", args, nil)
+// httpWithBody implements the functions whose third argument is the request body
+func httpWithBody(c *HTTPClient, method, name string) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(fc *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 4 {
+			return nil, fmt.Errorf("%s supports 1-4 arguments, got %d", name, len(args))
+		}
+
+		var body []byte
+		if len(args) >= 3 && args[2] != nil {
+			bodyStr, ok := args[2].(string)
+			if !ok {
+				return nil, fmt.Errorf("%s body argument must be a string, got %T", name, args[2])
+			}
+			body = []byte(bodyStr)
+		}
+
+		return c.makeRequest(requestContext(fc), method, args, body, 3)
+	}
 }
 
-// makeRequest is a helper function that handles the common HTTP request logic
-func makeRequest(method string, args []driver.Value, body []byte) (driver.Value, error) {
+// makeRequest is a helper function that handles the common HTTP request logic.
+// requestCtx is the context of the request the function is called for, and optionsIndex
+// is the position of the options argument of the function.
+func (c *HTTPClient) makeRequest(requestCtx context.Context, method string, args []driver.Value, body []byte, optionsIndex int) (driver.Value, error) {
 	url, ok := args[0].(string)
 	if !ok {
 		return nil, fmt.Errorf("URL argument must be a string, got %T", args[0])
 	}
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+	options, err := c.parseOptions("")
+	if len(args) > optionsIndex && args[optionsIndex] != nil {
+		options, err = c.parseOptions(args[optionsIndex])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Outbound requests end with the request that made them
+	name := "http_" + strings.ToLower(method)
+	if err := checkCancelled(requestCtx, name); err != nil {
+		return nil, err
+	}
+
+	var cacheStatus string
+	ctx := context.WithValue(requestCtx, requestOptionsKey{}, options)
+	ctx = context.WithValue(ctx, cacheStatusKey{}, &cacheStatus)
+	if options.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.timeout)
+		defer cancel()
 	}
 
 	var req *http.Request
-	var err error
 
 	if body != nil {
-		req, err = http.NewRequest(method, url, bytes.NewReader(body))
+		req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	} else {
-		req, err = http.NewRequest(method, url, nil)
+		req, err = http.NewRequestWithContext(ctx, method, url, nil)
 	}
 
 	if err != nil {
@@ -109,7 +592,7 @@ func makeRequest(method string, args []driver.Value, body []byte) (driver.Value,
 	}
 
 	// Add headers if provided
-	if len(args) >= 2 {
+	if len(args) >= 2 && args[1] != nil {
 		headersJSON, ok := args[1].(string)
 		if !ok {
 			return nil, fmt.Errorf("headers argument must be a string, got %T", args[1])
@@ -132,22 +615,75 @@ func makeRequest(method string, args []driver.Value, body []byte) (driver.Value,
 		req.Header.Set("User-Agent", "wtfhttpd/1.0")
 	}
 
-	resp, err := client.Do(req)
+	c.requests.Add(1)
+
+	if err := c.checkHost(req.URL.Hostname()); err != nil {
+		c.blocked.Add(1)
+		return createErrorResponse(err), nil
+	}
+
+	startTime := time.Now()
+	result, err := c.do(req, options, &cacheStatus)
+	c.recordLatency(time.Since(startTime))
+
 	if err != nil {
+		// A cancelled request stops the query, instead of handing it an error response
+		if cancelled := checkCancelled(requestCtx, name); cancelled != nil {
+			c.failures.Add(1)
+			return nil, cancelled
+		}
+
+		var blocked *blockedError
+		if errors.As(err, &blocked) {
+			c.blocked.Add(1)
+		} else {
+			c.failures.Add(1)
+		}
 		return createErrorResponse(err), nil
 	}
-	defer resp.Body.Close()
 
-	return createSuccessResponse(resp)
+	return result, nil
 }
 
-// createSuccessResponse formats the HTTP response into our standard JSON format
-func createSuccessResponse(resp *http.Response) (driver.Value, error) {
-	responseBody, err := io.ReadAll(resp.Body)
+// do sends the request and formats the response, reading at most maxBodyBytes of the body
+func (c *HTTPClient) do(req *http.Request, options requestOptions, cacheStatus *string) (driver.Value, error) {
+	resp, err := c.client.Do(req)
 	if err != nil {
-		return createErrorResponse(err), nil
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	reader := io.Reader(resp.Body)
+	if options.maxBodyBytes > 0 {
+		reader = io.LimitReader(resp.Body, options.maxBodyBytes+1)
 	}
 
+	responseBody, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if options.maxBodyBytes > 0 && int64(len(responseBody)) > options.maxBodyBytes {
+		return nil, fmt.Errorf("response body is larger than %d bytes", options.maxBodyBytes)
+	}
+
+	return createSuccessResponse(resp, responseBody, *cacheStatus)
+}
+
+// recordLatency adds a finished request to the latency statistics
+func (c *HTTPClient) recordLatency(latency time.Duration) {
+	c.completed.Add(1)
+	c.totalLatency.Add(int64(latency))
+	for {
+		current := c.maxLatency.Load()
+		if int64(latency) <= current || c.maxLatency.CompareAndSwap(current, int64(latency)) {
+			return
+		}
+	}
+}
+
+// createSuccessResponse formats the HTTP response into our standard JSON format.
+// Responses that went through the HTTP cache say whether they were a hit.
+func createSuccessResponse(resp *http.Response, responseBody []byte, cacheStatus string) (driver.Value, error) {
 	// Format headers into our expected structure
 	headers := make(map[string][]string)
 	for key, values := range resp.Header {
@@ -161,6 +697,9 @@ func createSuccessResponse(resp *http.Response) (driver.Value, error) {
 		"body":        string(responseBody),
 		"error":       nil,
 	}
+	if cacheStatus != "" {
+		result["cache"] = cacheStatus
+	}
 
 	jsonResult, err := json.Marshal(result)
 	if err != nil {
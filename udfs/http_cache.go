@@ -0,0 +1,378 @@
+package udfs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// cacheableStatuses are the response statuses the HTTP cache stores
+var cacheableStatuses = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// cacheStatusKey carries a pointer the cache reports hit, revalidated or miss to
+type cacheStatusKey struct{}
+
+// cachingTransport is a HTTP cache for GET requests, persisted in SQLite.
+// It honours Cache-Control, Expires and Vary, and revalidates stale
+// responses with their ETag or Last-Modified date.
+type cachingTransport struct {
+	db           *sql.DB
+	next         http.RoundTripper
+	maxBodyBytes int64
+	hits         atomic.Int64
+}
+
+// cacheEntry is a stored response
+type cacheEntry struct {
+	statusCode int
+	status     string
+	header     http.Header
+	body       []byte
+	vary       map[string]string
+	storedAt   time.Time
+	expiresAt  time.Time
+}
+
+// cacheControl is a parsed Cache-Control header
+type cacheControl map[string]string
+
+// parseCacheControl parses the directives of a Cache-Control header, e.g. "public, max-age=60"
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// has reports whether a directive is present
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns the value of a directive like max-age
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	value, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// openHTTPCache opens the SQLite database of the HTTP cache, and removes
+// the entries that are expired and can't be revalidated
+func openHTTPCache(path string, next http.RoundTripper, maxBodyBytes int64) (*cachingTransport, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening HTTP cache %s: %v", path, err)
+	}
+	// A single connection keeps writes from different requests from running into each other
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS wtf_http_cache (
+			key TEXT PRIMARY KEY,
+			status_code INTEGER NOT NULL,
+			status TEXT NOT NULL,
+			headers TEXT NOT NULL,
+			body BLOB NOT NULL,
+			vary TEXT NOT NULL DEFAULT '{}',
+			stored_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL
+		)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating HTTP cache table: %v", err)
+	}
+
+	_, err = db.Exec(`
+		DELETE FROM wtf_http_cache
+		WHERE expires_at < ?
+		AND json_extract(headers, '$.Etag') IS NULL
+		AND json_extract(headers, '$.Last-Modified') IS NULL`, time.Now().Unix())
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error pruning HTTP cache: %v", err)
+	}
+
+	return &cachingTransport{db: db, next: next, maxBodyBytes: maxBodyBytes}, nil
+}
+
+// RoundTrip serves GET requests from the cache when it can, and stores the responses that allow it
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	options, _ := req.Context().Value(requestOptionsKey{}).(requestOptions)
+	requestCC := parseCacheControl(req.Header)
+	if req.Method != http.MethodGet || options.noCache || requestCC.has("no-store") || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	key := req.URL.String()
+	entry, err := t.load(key)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && !entry.matches(req) {
+		entry = nil
+	}
+
+	outgoing := req
+	if entry != nil {
+		if !requestCC.has("no-cache") && time.Now().Before(entry.expiresAt) {
+			t.hits.Add(1)
+			setCacheStatus(req.Context(), "hit")
+			return entry.response(req), nil
+		}
+
+		// Stale responses are revalidated, if they can be
+		etag, lastModified := entry.header.Get("ETag"), entry.header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			outgoing = req.Clone(req.Context())
+			if etag != "" {
+				outgoing.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				outgoing.Header.Set("If-Modified-Since", lastModified)
+			}
+		}
+	}
+
+	resp, err := t.next.RoundTrip(outgoing)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil && outgoing != req {
+		resp.Body.Close()
+
+		// The 304 updates the headers of the stored response, like its freshness
+		for name, values := range resp.Header {
+			if name != "Content-Length" {
+				entry.header[name] = values
+			}
+		}
+		entry.storedAt = time.Now()
+		entry.expiresAt = freshUntil(entry.header, entry.storedAt)
+		if err := t.store(key, entry); err != nil {
+			return nil, err
+		}
+
+		t.hits.Add(1)
+		setCacheStatus(req.Context(), "revalidated")
+		return entry.response(req), nil
+	}
+
+	setCacheStatus(req.Context(), "miss")
+	if !isStorable(req, resp) {
+		return resp, nil
+	}
+
+	// Read the body to store it, unless it's larger than a response may be
+	limit := t.maxBodyBytes
+	if limit <= 0 {
+		limit = 10 << 20
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	now := time.Now()
+	entry = &cacheEntry{
+		statusCode: resp.StatusCode,
+		status:     resp.Status,
+		header:     resp.Header.Clone(),
+		body:       body,
+		vary:       varyValues(req, resp.Header),
+		storedAt:   now,
+		expiresAt:  freshUntil(resp.Header, now),
+	}
+	if err := t.store(key, entry); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// readCloser joins a reader with the closer of the body it reads from
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// setCacheStatus reports how the cache served a request to the http_* function that made it
+func setCacheStatus(ctx context.Context, status string) {
+	if p, ok := ctx.Value(cacheStatusKey{}).(*string); ok {
+		*p = status
+	}
+}
+
+// isStorable reports whether a response may be stored. Responses need a freshness
+// lifetime or a validator, and responses to requests with credentials have to be public.
+func isStorable(req *http.Request, resp *http.Response) bool {
+	if !cacheableStatuses[resp.StatusCode] {
+		return false
+	}
+
+	cc := parseCacheControl(resp.Header)
+	if cc.has("no-store") || cc.has("private") || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+
+	if req.Header.Get("Authorization") != "" &&
+		!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+
+	return freshUntil(resp.Header, time.Now()).After(time.Now()) ||
+		resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// freshUntil returns when a response received at the given time becomes stale,
+// from its s-maxage, max-age or Expires header, less its Age
+func freshUntil(header http.Header, received time.Time) time.Time {
+	cc := parseCacheControl(header)
+	if cc.has("no-cache") {
+		return received
+	}
+
+	lifetime, ok := cc.seconds("s-maxage")
+	if !ok {
+		lifetime, ok = cc.seconds("max-age")
+	}
+	if !ok {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return received
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = received
+		}
+		lifetime = expires.Sub(date)
+	}
+
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	return received.Add(lifetime)
+}
+
+// varyValues returns the request headers named by the Vary header of a response
+func varyValues(req *http.Request, header http.Header) map[string]string {
+	values := map[string]string{}
+	for _, vary := range header.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+				values[name] = req.Header.Get(name)
+			}
+		}
+	}
+	return values
+}
+
+// matches reports whether a request has the headers the stored response varies on
+func (e *cacheEntry) matches(req *http.Request) bool {
+	for name, value := range e.vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// response builds the response to a request from a stored response
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.FormatInt(int64(time.Since(e.storedAt).Seconds()), 10))
+
+	return &http.Response{
+		Status:        e.status,
+		StatusCode:    e.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// load returns the stored response for a key, if there is one
+func (t *cachingTransport) load(key string) (*cacheEntry, error) {
+	var entry cacheEntry
+	var headers, vary string
+	var storedAt, expiresAt int64
+
+	err := t.db.QueryRow(`
+		SELECT status_code, status, headers, body, vary, stored_at, expires_at
+		FROM wtf_http_cache WHERE key = ?`, key).
+		Scan(&entry.statusCode, &entry.status, &headers, &entry.body, &vary, &storedAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading HTTP cache: %v", err)
+	}
+
+	if err := json.Unmarshal([]byte(headers), &entry.header); err != nil {
+		return nil, fmt.Errorf("error decoding cached headers: %v", err)
+	}
+	if err := json.Unmarshal([]byte(vary), &entry.vary); err != nil {
+		return nil, fmt.Errorf("error decoding cached vary headers: %v", err)
+	}
+	entry.storedAt = time.Unix(storedAt, 0)
+	entry.expiresAt = time.Unix(expiresAt, 0)
+
+	return &entry, nil
+}
+
+// store saves a response under a key, replacing the response stored before
+func (t *cachingTransport) store(key string, entry *cacheEntry) error {
+	headers, err := json.Marshal(entry.header)
+	if err != nil {
+		return err
+	}
+	vary, err := json.Marshal(entry.vary)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.db.Exec(`
+		INSERT OR REPLACE INTO wtf_http_cache (key, status_code, status, headers, body, vary, stored_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		key, entry.statusCode, entry.status, string(headers), entry.body, string(vary),
+		entry.storedAt.Unix(), entry.expiresAt.Unix())
+	if err != nil {
+		return fmt.Errorf("error writing HTTP cache: %v", err)
+	}
+	return nil
+}
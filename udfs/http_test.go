@@ -0,0 +1,190 @@
+package udfs
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.8.9.10", true},
+		{"::1", true},
+		{"10.0.0.1", true},
+		{"172.16.5.4", true},
+		{"172.31.255.255", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"fe80::1", true},
+		{"fc00::1", true},
+		{"0.0.0.0", true},
+		{"::", true},
+		{"100.64.0.1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:192.168.1.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"172.32.0.1", false},
+		{"8.8.8.8", false},
+		{"93.184.216.34", false},
+		{"::ffff:8.8.8.8", false},
+		{"2606:4700:4700::1111", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPrivateIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPrivateIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  HTTPConfig
+		host    string
+		ip      string
+		blocked bool
+	}{
+		{"public", HTTPConfig{BlockPrivate: true}, "example.com", "93.184.216.34", false},
+		{"loopback", HTTPConfig{BlockPrivate: true}, "example.com", "127.0.0.1", true},
+		{"IPv6 loopback", HTTPConfig{BlockPrivate: true}, "example.com", "::1", true},
+		{"RFC1918", HTTPConfig{BlockPrivate: true}, "example.com", "192.168.0.10", true},
+		{"link local metadata service", HTTPConfig{BlockPrivate: true}, "example.com", "169.254.169.254", true},
+		{"IPv6 link local", HTTPConfig{BlockPrivate: true}, "example.com", "fe80::1", true},
+		{"IPv4-mapped loopback", HTTPConfig{BlockPrivate: true}, "example.com", "::ffff:127.0.0.1", true},
+		{"IPv4-mapped RFC1918", HTTPConfig{BlockPrivate: true}, "example.com", "::ffff:10.1.2.3", true},
+		{"private allowed when not blocked", HTTPConfig{}, "example.com", "127.0.0.1", false},
+		{"allowed host may be private", HTTPConfig{BlockPrivate: true, AllowHosts: []string{"localhost"}}, "localhost", "127.0.0.1", false},
+		{"host off the allow list", HTTPConfig{AllowHosts: []string{"api.example.com"}}, "evil.example.org", "93.184.216.34", true},
+		{"allowed IP range doesn't allow host names", HTTPConfig{BlockPrivate: true, AllowHosts: []string{"10.0.0.0/8"}}, "internal.example.com", "10.0.0.5", true},
+		{"denied range", HTTPConfig{DenyHosts: []string{"203.0.113.0/24"}}, "example.com", "203.0.113.5", true},
+		{"denied range as IPv4-mapped", HTTPConfig{DenyHosts: []string{"203.0.113.0/24"}}, "example.com", "::ffff:203.0.113.5", true},
+		{"denied range wins over the allow list", HTTPConfig{AllowHosts: []string{"example.com"}, DenyHosts: []string{"203.0.113.0/24"}}, "example.com", "203.0.113.5", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewHTTPClient(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = c.checkIP(tt.host, net.ParseIP(tt.ip))
+			if blocked := err != nil; blocked != tt.blocked {
+				t.Errorf("checkIP(%s, %s) = %v, want blocked %v", tt.host, tt.ip, err, tt.blocked)
+			}
+		})
+	}
+}
+
+func TestCheckHost(t *testing.T) {
+	c, err := NewHTTPClient(HTTPConfig{
+		AllowHosts: []string{"api.example.com", "*.example.org", "127.0.0.1", "10.0.0.0/8"},
+		DenyHosts:  []string{"admin.example.org"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string
+		blocked bool
+	}{
+		{"api.example.com", false},
+		{"API.Example.com", false},
+		{"www.example.com", true},
+		{"a.example.org", false},
+		{"example.org", true},
+		{"evilexample.org", true},
+		{"admin.example.org", true},
+		{"127.0.0.1", false},
+		{"10.2.3.4", false},
+		{"localhost", true},
+		{"11.0.0.1", true},
+	}
+
+	for _, tt := range tests {
+		err := c.checkHost(tt.host)
+		if blocked := err != nil; blocked != tt.blocked {
+			t.Errorf("checkHost(%s) = %v, want blocked %v", tt.host, err, tt.blocked)
+		}
+	}
+}
+
+// roundTripFunc answers requests with a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRedirectToPrivateHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   HTTPConfig
+		location string
+	}{
+		{"loopback", HTTPConfig{BlockPrivate: true}, "http://127.0.0.1:1/"},
+		{"metadata service", HTTPConfig{BlockPrivate: true}, "http://169.254.169.254/latest/meta-data/"},
+		{"IPv4-mapped loopback", HTTPConfig{BlockPrivate: true}, "http://[::ffff:127.0.0.1]:1/"},
+		{"localhost", HTTPConfig{BlockPrivate: true}, "http://localhost:1/"},
+		{"host off the allow list", HTTPConfig{AllowHosts: []string{"public.example"}}, "http://internal.example/"},
+		{"denied host", HTTPConfig{DenyHosts: []string{"internal.example"}}, "http://internal.example/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.FollowRedirects = true
+			tt.config.MaxRedirects = 10
+			tt.config.Timeout = 5 * time.Second
+			c, err := NewHTTPClient(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The public host is answered without the network, and redirects to the private
+			// one, which goes through the client's own transport
+			transport := c.client.Transport
+			c.client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.Host != "public.example" {
+					return transport.RoundTrip(req)
+				}
+				return &http.Response{
+					StatusCode: http.StatusFound,
+					Status:     "302 Found",
+					Header:     http.Header{"Location": {tt.location}},
+					Body:       http.NoBody,
+					Request:    req,
+				}, nil
+			})
+
+			result, err := c.makeRequest(context.Background(), "GET", []driver.Value{"http://public.example/"}, nil, 2)
+			if err != nil {
+				t.Fatalf("makeRequest error: %v", err)
+			}
+
+			var response struct {
+				StatusCode int     `json:"status_code"`
+				Error      *string `json:"error"`
+			}
+			if err := json.Unmarshal([]byte(result.(string)), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Error == nil || !strings.Contains(*response.Error, "are not allowed") {
+				t.Errorf("redirect to %s wasn't blocked: %s", tt.location, result)
+			}
+			if blocked := c.Stats().Blocked; blocked != 1 {
+				t.Errorf("Stats().Blocked = %d, want 1", blocked)
+			}
+		})
+	}
+}
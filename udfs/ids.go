@@ -0,0 +1,121 @@
+package udfs
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"modernc.org/sqlite"
+)
+
+// uuidV4 generates a random UUID
+func uuidV4(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("uuid_v4 supports 0 arguments, got %d", len(args))
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("uuid_v4 error: %v", err)
+	}
+	return id.String(), nil
+}
+
+// uuidV7 generates a UUID starting with the current time, so they sort in the order they were made
+func uuidV7(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("uuid_v7 supports 0 arguments, got %d", len(args))
+	}
+
+	id, err := uuid.NewV7()
+	if err != nil {
+		return nil, fmt.Errorf("uuid_v7 error: %v", err)
+	}
+	return id.String(), nil
+}
+
+// crockfordAlphabet is the base32 alphabet of ULIDs, without I, L, O and U
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulid generates a ULID: 48 bits of milliseconds since the epoch and 80 random
+// bits, as 26 characters of Crockford base32 that sort in time order
+func ulid(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 0 {
+		return nil, fmt.Errorf("ulid supports 0 arguments, got %d", len(args))
+	}
+
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		return nil, fmt.Errorf("failed to generate secure random bytes: %v", err)
+	}
+
+	// 128 bits are 26 characters of 5 bits, the first of which only has 3
+	out := make([]byte, 26)
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out), nil
+}
+
+// nanoidAlphabet is the default alphabet of nanoid, which is URL safe
+const nanoidAlphabet = "_-0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// nanoid generates a random ID of the given size (default 21) from an alphabet
+// (default: letters, digits, _ and -). Usage: nanoid([size], [alphabet])
+func nanoid(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) > 2 {
+		return nil, fmt.Errorf("nanoid supports up to 2 arguments, got %d", len(args))
+	}
+
+	size := int64(21)
+	if len(args) > 0 {
+		n, ok := args[0].(int64)
+		if !ok || n <= 0 || n > 1024 {
+			return nil, fmt.Errorf("nanoid size must be an integer from 1 to 1024, got %v", args[0])
+		}
+		size = n
+	}
+
+	alphabet := []rune(nanoidAlphabet)
+	if len(args) > 1 {
+		text, err := textArg("nanoid alphabet", args[1])
+		if err != nil {
+			return nil, err
+		}
+		if utf8.RuneCountInString(text) < 2 || utf8.RuneCountInString(text) > 256 {
+			return nil, fmt.Errorf("nanoid alphabet must have from 2 to 256 characters")
+		}
+		alphabet = []rune(text)
+	}
+
+	// Random bytes are masked to the smallest power of two covering the alphabet,
+	// and the ones past its end are skipped, so every character is equally likely
+	mask := 1<<bits.Len(uint(len(alphabet)-1)) - 1
+
+	id := make([]rune, 0, size)
+	buf := make([]byte, size*2)
+	for int64(len(id)) < size {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("failed to generate secure random bytes: %v", err)
+		}
+		for _, b := range buf {
+			if i := int(b) & mask; i < len(alphabet) {
+				id = append(id, alphabet[i])
+				if int64(len(id)) == size {
+					break
+				}
+			}
+		}
+	}
+	return string(id), nil
+}
@@ -0,0 +1,116 @@
+package udfs
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestULID(t *testing.T) {
+	previous := ""
+	for i := 0; i < 100; i++ {
+		value, err := ulid(nil, nil)
+		if err != nil {
+			t.Fatalf("ulid error: %v", err)
+		}
+		id := value.(string)
+
+		if len(id) != 26 {
+			t.Fatalf("ulid %q has %d characters, want 26", id, len(id))
+		}
+		for _, c := range id {
+			if !strings.ContainsRune(crockfordAlphabet, c) {
+				t.Fatalf("ulid %q has %q, which isn't Crockford base32", id, c)
+			}
+		}
+		// 48 bits of time take the first 10 characters, the first of which only has 3 bits
+		if id[0] > '7' {
+			t.Fatalf("ulid %q overflows 128 bits", id)
+		}
+
+		// ULIDs made in later milliseconds sort after the earlier ones
+		if previous != "" && id[:10] < previous[:10] {
+			t.Fatalf("ulid %q sorts before %q, which was made earlier", id, previous)
+		}
+		previous = id
+
+		if i%10 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestULIDTimestamp(t *testing.T) {
+	before := time.Now().UnixMilli()
+	value, err := ulid(nil, nil)
+	if err != nil {
+		t.Fatalf("ulid error: %v", err)
+	}
+	after := time.Now().UnixMilli()
+
+	var millis int64
+	for _, c := range value.(string)[:10] {
+		millis = millis<<5 | int64(strings.IndexRune(crockfordAlphabet, c))
+	}
+	if millis < before || millis > after {
+		t.Errorf("ulid time is %d, want from %d to %d", millis, before, after)
+	}
+}
+
+func TestNanoid(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []driver.Value
+		size     int
+		alphabet string
+	}{
+		{"default", nil, 21, nanoidAlphabet},
+		{"size", []driver.Value{int64(8)}, 8, nanoidAlphabet},
+		{"smallest", []driver.Value{int64(1)}, 1, nanoidAlphabet},
+		{"largest", []driver.Value{int64(1024)}, 1024, nanoidAlphabet},
+		{"alphabet", []driver.Value{int64(64), "ab"}, 64, "ab"},
+		{"odd alphabet", []driver.Value{int64(64), "0123456789"}, 64, "0123456789"},
+		{"unicode alphabet", []driver.Value{int64(32), "αβγδ"}, 32, "αβγδ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := nanoid(nil, tt.args)
+			if err != nil {
+				t.Fatalf("nanoid error: %v", err)
+			}
+			id := value.(string)
+
+			if n := utf8.RuneCountInString(id); n != tt.size {
+				t.Errorf("nanoid %q has %d characters, want %d", id, n, tt.size)
+			}
+			for _, c := range id {
+				if !strings.ContainsRune(tt.alphabet, c) {
+					t.Errorf("nanoid %q has %q, which isn't in %q", id, c, tt.alphabet)
+				}
+			}
+		})
+	}
+}
+
+func TestNanoidBounds(t *testing.T) {
+	tests := []struct {
+		name string
+		args []driver.Value
+	}{
+		{"zero size", []driver.Value{int64(0)}},
+		{"negative size", []driver.Value{int64(-1)}},
+		{"too large", []driver.Value{int64(1025)}},
+		{"text size", []driver.Value{"21"}},
+		{"one character alphabet", []driver.Value{int64(21), "a"}},
+		{"too many arguments", []driver.Value{int64(21), "ab", "c"}},
+	}
+
+	for _, tt := range tests {
+		if _, err := nanoid(nil, tt.args); err == nil {
+			t.Errorf("nanoid with %s didn't fail", tt.name)
+		}
+	}
+}
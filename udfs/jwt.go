@@ -0,0 +1,556 @@
+package udfs
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// JWT algorithms
+const (
+	JWTHS256 = "HS256"
+	JWTRS256 = "RS256"
+	JWTEdDSA = "EdDSA"
+)
+
+// JWTKeyConfig is a key for signing or verifying tokens. HS256 keys have a secret,
+// RS256 and EdDSA keys a PEM private key to sign with, or only a public key to verify with.
+type JWTKeyConfig struct {
+	ID             string
+	Algorithm      string
+	Secret         string
+	PrivateKeyFile string
+	PublicKeyFile  string
+}
+
+// JWTConfig holds the keys and claims checks of the jwt_* functions
+type JWTConfig struct {
+	Keys []JWTKeyConfig
+	// JWKSFile is a JSON Web Key Set of more keys, e.g. the public keys of an identity provider
+	JWKSFile string
+	// DefaultKey is the ID of the key jwt_sign uses when it isn't given one
+	DefaultKey string
+	Issuer     string
+	Audience   string
+	// TTL is the lifetime of signed tokens that don't have an exp claim
+	TTL time.Duration
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat
+	Leeway time.Duration
+}
+
+// jwtKey is a parsed key
+type jwtKey struct {
+	id        string
+	algorithm string
+	secret    []byte
+	private   crypto.Signer
+	public    crypto.PublicKey
+}
+
+// JWT signs and verifies JSON Web Tokens with the configured keys
+type JWT struct {
+	config JWTConfig
+	keys   map[string]*jwtKey
+	order  []*jwtKey
+}
+
+// NewJWT loads the keys of the jwt_* functions. Without keys, the functions report an error when they're called.
+func NewJWT(config JWTConfig) (*JWT, error) {
+	j := &JWT{config: config, keys: map[string]*jwtKey{}}
+
+	for _, kc := range config.Keys {
+		key, err := loadJWTKey(kc)
+		if err != nil {
+			return nil, fmt.Errorf("error loading JWT key %s: %v", kc.ID, err)
+		}
+		j.add(key)
+	}
+
+	if config.JWKSFile != "" {
+		keys, err := loadJWKS(config.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading JWKS %s: %v", config.JWKSFile, err)
+		}
+		for _, key := range keys {
+			j.add(key)
+		}
+	}
+
+	if config.DefaultKey != "" && j.keys[config.DefaultKey] == nil {
+		return nil, fmt.Errorf("unknown default JWT key %s", config.DefaultKey)
+	}
+
+	return j, nil
+}
+
+func (j *JWT) add(key *jwtKey) {
+	j.keys[key.id] = key
+	j.order = append(j.order, key)
+}
+
+// loadJWTKey parses a key from the config
+func loadJWTKey(kc JWTKeyConfig) (*jwtKey, error) {
+	key := &jwtKey{id: kc.ID, algorithm: kc.Algorithm}
+
+	switch kc.Algorithm {
+	case JWTHS256:
+		if kc.Secret == "" {
+			return nil, errors.New("HS256 keys need a secret")
+		}
+		key.secret = []byte(kc.Secret)
+		return key, nil
+	case JWTRS256, JWTEdDSA:
+	default:
+		return nil, fmt.Errorf("unsupported algorithm '%s', expected HS256, RS256 or EdDSA", kc.Algorithm)
+	}
+
+	if kc.PrivateKeyFile != "" {
+		block, err := readPEM(kc.PrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("invalid private key in %s: %v", kc.PrivateKeyFile, err)
+			}
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key in %s", kc.PrivateKeyFile)
+		}
+		key.private = signer
+		key.public = signer.Public()
+	} else if kc.PublicKeyFile != "" {
+		block, err := readPEM(kc.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			if parsed, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("invalid public key in %s: %v", kc.PublicKeyFile, err)
+			}
+		}
+		key.public = parsed
+	} else {
+		return nil, fmt.Errorf("%s keys need a private_key_file or public_key_file", kc.Algorithm)
+	}
+
+	if err := key.checkType(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkType checks that a public key is of the type its algorithm uses
+func (k *jwtKey) checkType() error {
+	switch k.public.(type) {
+	case *rsa.PublicKey:
+		if k.algorithm != JWTRS256 {
+			return fmt.Errorf("RSA keys can't be used with %s", k.algorithm)
+		}
+	case ed25519.PublicKey:
+		if k.algorithm != JWTEdDSA {
+			return fmt.Errorf("Ed25519 keys can't be used with %s", k.algorithm)
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", k.public)
+	}
+	return nil
+}
+
+// readPEM reads the first PEM block of a file
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+	return block, nil
+}
+
+// jwk is a JSON Web Key, of the types the jwt_* functions support
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	D   string `json:"d"`
+}
+
+// loadJWKS reads the keys of a JSON Web Key Set. Keys for encryption,
+// and of types that aren't supported, are skipped.
+func loadJWKS(path string) ([]*jwtKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	b64 := base64.RawURLEncoding
+	var keys []*jwtKey
+	for i, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		if k.Kid == "" {
+			k.Kid = fmt.Sprintf("jwks-%d", i)
+		}
+
+		key := &jwtKey{id: k.Kid}
+		switch {
+		case k.Kty == "oct":
+			secret, err := b64.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %s: %v", k.Kid, err)
+			}
+			key.algorithm, key.secret = JWTHS256, secret
+		case k.Kty == "RSA":
+			n, err := b64.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %s: %v", k.Kid, err)
+			}
+			e, err := b64.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("invalid key %s: %v", k.Kid, err)
+			}
+			key.algorithm = JWTRS256
+			key.public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "OKP" && k.Crv == "Ed25519":
+			x, err := b64.DecodeString(k.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid key %s", k.Kid)
+			}
+			key.algorithm = JWTEdDSA
+			key.public = ed25519.PublicKey(x)
+			if k.D != "" {
+				d, err := b64.DecodeString(k.D)
+				if err != nil || len(d) != ed25519.SeedSize {
+					return nil, fmt.Errorf("invalid key %s", k.Kid)
+				}
+				key.private = ed25519.NewKeyFromSeed(d)
+			}
+		default:
+			continue
+		}
+
+		if k.Alg != "" && k.Alg != key.algorithm {
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// sign signs the header and payload of a token
+func (k *jwtKey) sign(input []byte) ([]byte, error) {
+	switch k.algorithm {
+	case JWTHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case JWTRS256:
+		if k.private == nil {
+			return nil, fmt.Errorf("key %s can only verify tokens", k.id)
+		}
+		digest := sha256.Sum256(input)
+		return k.private.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case JWTEdDSA:
+		if k.private == nil {
+			return nil, fmt.Errorf("key %s can only verify tokens", k.id)
+		}
+		return k.private.Sign(rand.Reader, input, crypto.Hash(0))
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s", k.algorithm)
+}
+
+// verify checks the signature of the header and payload of a token
+func (k *jwtKey) verify(input, signature []byte) bool {
+	switch k.algorithm {
+	case JWTHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case JWTRS256:
+		public, ok := k.public.(*rsa.PublicKey)
+		digest := sha256.Sum256(input)
+		return ok && rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) == nil
+	case JWTEdDSA:
+		public, ok := k.public.(ed25519.PublicKey)
+		return ok && ed25519.Verify(public, input, signature)
+	}
+	return false
+}
+
+// Sign signs claims with a key, or the default key. It adds the iat claim, and the
+// exp, iss and aud claims from the config when the claims don't have them.
+func (j *JWT) Sign(claims map[string]any, keyID string) (string, error) {
+	if keyID == "" {
+		keyID = j.config.DefaultKey
+	}
+	if keyID == "" && len(j.order) == 1 {
+		keyID = j.order[0].id
+	}
+
+	key := j.keys[keyID]
+	if key == nil {
+		if keyID == "" {
+			return "", errors.New("no key given, and jwt_default_key isn't set")
+		}
+		return "", fmt.Errorf("unknown key %s", keyID)
+	}
+
+	now := time.Now()
+	if _, ok := claims["iat"]; !ok {
+		claims["iat"] = now.Unix()
+	}
+	if _, ok := claims["exp"]; !ok && j.config.TTL > 0 {
+		claims["exp"] = now.Add(j.config.TTL).Unix()
+	}
+	if _, ok := claims["iss"]; !ok && j.config.Issuer != "" {
+		claims["iss"] = j.config.Issuer
+	}
+	if _, ok := claims["aud"]; !ok && j.config.Audience != "" {
+		claims["aud"] = j.config.Audience
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": key.algorithm, "typ": "JWT", "kid": key.id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	b64 := base64.RawURLEncoding
+	input := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	signature, err := key.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + b64.EncodeToString(signature), nil
+}
+
+// Verify checks the signature and claims of a token, and returns its claims. The key is
+// picked by the kid header, or else tried with every key of the token's algorithm. The
+// algorithm has to be the key's, so a public key can't be used as a HMAC secret.
+func (j *JWT) Verify(token, audience string) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	b64 := base64.RawURLEncoding
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	headerJSON, err := b64.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	candidates := j.order
+	if header.Kid != "" {
+		candidates = nil
+		if key := j.keys[header.Kid]; key != nil {
+			candidates = []*jwtKey{key}
+		}
+	}
+
+	input := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range candidates {
+		if key.algorithm == header.Alg && key.verify(input, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	var claims map[string]any
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+
+	if err := j.checkClaims(claims, audience); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims checks the time claims, allowing for the leeway, and the issuer and audience
+func (j *JWT) checkClaims(claims map[string]any, audience string) error {
+	now := time.Now()
+	leeway := j.config.Leeway
+
+	if exp, ok := numericDate(claims["exp"]); ok && !now.Before(exp.Add(leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Add(leeway).Before(nbf) {
+		return errors.New("token not valid yet")
+	}
+	if iat, ok := numericDate(claims["iat"]); ok && now.Add(leeway).Before(iat) {
+		return errors.New("token issued in the future")
+	}
+
+	if j.config.Issuer != "" && claims["iss"] != j.config.Issuer {
+		return errors.New("wrong issuer")
+	}
+
+	if audience == "" {
+		audience = j.config.Audience
+	}
+	if audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == audience
+		case []any:
+			for _, a := range aud {
+				if a == audience {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return errors.New("wrong audience")
+		}
+	}
+
+	return nil
+}
+
+// numericDate reads a NumericDate claim, the seconds since the epoch
+func numericDate(value any) (time.Time, bool) {
+	n, ok := value.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+// jwtSign signs a JSON object of claims, returning the token.
+// Usage: jwt_sign(claims_json, [key_id])
+func jwtSign(j *JWT) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("jwt_sign supports 1 or 2 arguments, got %d", len(args))
+		}
+		if len(j.order) == 0 {
+			return nil, fmt.Errorf("jwt_sign requires a key in the jwt_keys of wtf.toml")
+		}
+
+		claimsJSON, err := textArg("jwt_sign claims", args[0])
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(strings.NewReader(claimsJSON))
+		decoder.UseNumber()
+		var claims map[string]any
+		if err := decoder.Decode(&claims); err != nil || claims == nil {
+			return nil, fmt.Errorf("jwt_sign claims must be a JSON object")
+		}
+
+		keyID := ""
+		if len(args) == 2 {
+			if keyID, err = textArg("jwt_sign key id", args[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		token, err := j.Sign(claims, keyID)
+		if err != nil {
+			return nil, fmt.Errorf("jwt_sign error: %v", err)
+		}
+		return token, nil
+	}
+}
+
+// jwtVerify returns the claims of a token as JSON, or NULL if the token
+// is invalid, expired or for another audience.
+// Usage: jwt_verify(token, [audience])
+func jwtVerify(j *JWT) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 1 || len(args) > 2 {
+			return nil, fmt.Errorf("jwt_verify supports 1 or 2 arguments, got %d", len(args))
+		}
+		if len(j.order) == 0 {
+			return nil, fmt.Errorf("jwt_verify requires a key in the jwt_keys of wtf.toml")
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+
+		token, err := textArg("jwt_verify token", args[0])
+		if err != nil {
+			return nil, err
+		}
+		audience := ""
+		if len(args) == 2 {
+			if audience, err = textArg("jwt_verify audience", args[1]); err != nil {
+				return nil, err
+			}
+		}
+
+		claims, err := j.Verify(token, audience)
+		if err != nil {
+			return nil, nil
+		}
+
+		encoded, err := json.Marshal(claims)
+		if err != nil {
+			return nil, err
+		}
+		return string(encoded), nil
+	}
+}
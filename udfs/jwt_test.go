@@ -0,0 +1,184 @@
+package udfs
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testJWT returns a JWT with a HS256 key "hs" and an EdDSA key "ed", and the Ed25519 private key
+func testJWT(t *testing.T, audience string) (*JWT, ed25519.PrivateKey) {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "ed.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := NewJWT(JWTConfig{
+		Keys: []JWTKeyConfig{
+			{ID: "hs", Algorithm: JWTHS256, Secret: "secret"},
+			{ID: "ed", Algorithm: JWTEdDSA, PrivateKeyFile: keyFile},
+		},
+		Audience: audience,
+		Leeway:   30 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, private
+}
+
+// craftToken builds a token with any header, signed by sign
+func craftToken(t *testing.T, header, claims map[string]any, sign func(input []byte) []byte) string {
+	t.Helper()
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding
+	input := b64.EncodeToString(headerJSON) + "." + b64.EncodeToString(claimsJSON)
+	return input + "." + b64.EncodeToString(sign([]byte(input)))
+}
+
+func hmacSign(secret []byte) func([]byte) []byte {
+	return func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+}
+
+func TestJWTVerifyAlgorithms(t *testing.T) {
+	j, private := testJWT(t, "")
+	public := private.Public().(ed25519.PublicKey)
+	claims := map[string]any{"sub": "42"}
+	noSignature := func([]byte) []byte { return nil }
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"HS256", craftToken(t, map[string]any{"alg": "HS256", "kid": "hs"}, claims, hmacSign([]byte("secret"))), ""},
+		{"EdDSA", craftToken(t, map[string]any{"alg": "EdDSA", "kid": "ed"}, claims, func(input []byte) []byte {
+			return ed25519.Sign(private, input)
+		}), ""},
+		{"without a kid", craftToken(t, map[string]any{"alg": "HS256"}, claims, hmacSign([]byte("secret"))), ""},
+		{"public key as a HMAC secret", craftToken(t, map[string]any{"alg": "HS256", "kid": "ed"}, claims, hmacSign(public)), "invalid signature"},
+		{"public key as a HMAC secret without a kid", craftToken(t, map[string]any{"alg": "HS256"}, claims, hmacSign(public)), "invalid signature"},
+		{"kid of another algorithm", craftToken(t, map[string]any{"alg": "EdDSA", "kid": "hs"}, claims, func(input []byte) []byte {
+			return ed25519.Sign(private, input)
+		}), "invalid signature"},
+		{"alg none", craftToken(t, map[string]any{"alg": "none"}, claims, noSignature), "invalid signature"},
+		{"alg none with a kid", craftToken(t, map[string]any{"alg": "none", "kid": "hs"}, claims, noSignature), "invalid signature"},
+		{"unknown kid", craftToken(t, map[string]any{"alg": "HS256", "kid": "other"}, claims, hmacSign([]byte("secret"))), "invalid signature"},
+		{"wrong secret", craftToken(t, map[string]any{"alg": "HS256", "kid": "hs"}, claims, hmacSign([]byte("guess"))), "invalid signature"},
+		{"malformed", "not.a-token", "malformed token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := j.Verify(tt.token, "")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() error: %v", err)
+			}
+			if got["sub"] != "42" {
+				t.Errorf("Verify() claims = %v", got)
+			}
+		})
+	}
+}
+
+func TestJWTVerifyTampered(t *testing.T) {
+	j, _ := testJWT(t, "")
+
+	token, err := j.Sign(map[string]any{"sub": "42", "admin": false}, "hs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(map[string]any{"sub": "42", "admin": true})
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+
+	if _, err := j.Verify(strings.Join(parts, "."), ""); err == nil || err.Error() != "invalid signature" {
+		t.Errorf("Verify() of a tampered token error = %v, want invalid signature", err)
+	}
+}
+
+func TestJWTVerifyClaims(t *testing.T) {
+	now := time.Now().Unix()
+
+	tests := []struct {
+		name     string
+		audience string // of the config
+		verify   string // given to Verify
+		claims   map[string]any
+		wantErr  string
+	}{
+		{"not expired", "", "", map[string]any{"exp": now + 60}, ""},
+		{"expired within the leeway", "", "", map[string]any{"exp": now - 10}, ""},
+		{"expired outside the leeway", "", "", map[string]any{"exp": now - 60}, "token expired"},
+		{"not valid yet within the leeway", "", "", map[string]any{"nbf": now + 10}, ""},
+		{"not valid yet outside the leeway", "", "", map[string]any{"nbf": now + 60}, "token not valid yet"},
+		{"issued in the future", "", "", map[string]any{"iat": now + 60}, "token issued in the future"},
+		{"audience string", "api", "", map[string]any{"aud": "api"}, ""},
+		{"wrong audience string", "api", "", map[string]any{"aud": "web"}, "wrong audience"},
+		{"audience array", "api", "", map[string]any{"aud": []string{"web", "api"}}, ""},
+		{"wrong audience array", "api", "", map[string]any{"aud": []string{"web", "admin"}}, "wrong audience"},
+		{"missing audience", "api", "", map[string]any{}, "wrong audience"},
+		{"audience of the call", "api", "web", map[string]any{"aud": "web"}, ""},
+		{"audience of the call in an array", "", "web", map[string]any{"aud": []string{"web"}}, ""},
+		{"config audience isn't the call's", "api", "web", map[string]any{"aud": "api"}, "wrong audience"},
+		{"no audience required", "", "", map[string]any{"aud": "anything"}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j, _ := testJWT(t, tt.audience)
+			token := craftToken(t, map[string]any{"alg": "HS256", "kid": "hs"}, tt.claims, hmacSign([]byte("secret")))
+
+			_, err := j.Verify(token, tt.verify)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Verify() error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -5,52 +5,161 @@ import (
 	"log"
 
 	"github.com/sad-pixel/wtfhttpd/cache"
+	"github.com/yuin/goldmark"
 	"modernc.org/sqlite"
 )
 
-func RegisterUdfs(kv *cache.KVCache) {
-	functions := []struct {
-		name          string
-		nArgs         int32
-		deterministic bool
-		scalar        func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error)
-	}{
+// Function is a user defined function available to SQL queries and templates
+type Function struct {
+	Name          string
+	NArgs         int32
+	Deterministic bool
+	Scalar        func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error)
+}
+
+// Functions returns every user defined function provided by wtfhttpd
+func Functions(kv *cache.KVCache, client *HTTPClient, crypto *Crypto, jwt *JWT, md goldmark.Markdown) []Function {
+	return []Function{
 		{"slugify", 1, true, slugify},
-		{"wtf_abort", -1, true, wtfAbort},     // variadic - can take 0, 1, 2
-		{"bcrypt_hash", -1, true, bcryptHash}, // can take 1 or 2 arguments
+		{"wtf_abort", -1, false, wtfAbort},     // variadic - can take 0, 1, 2
+		{"bcrypt_hash", -1, false, bcryptHash}, // can take 1 or 2 arguments
 		{"bcrypt_verify", 2, true, bcryptVerify},
 		{"checksum_md5", 1, true, md5Hash},
 		{"checksum_sha1", 1, true, sha1Hash},
-		{"cache_set", 2, true, KVSet(kv)},
-		{"cache_get", 1, true, KVGet(kv)},
-		{"cache_delete", 1, true, KVDelete(kv)},
-		{"secure_hex", 1, true, secureHex},
+		{"cache_set", 2, false, KVSet(kv)},
+		{"cache_get", 1, false, KVGet(kv)},
+		{"cache_delete", 1, false, KVDelete(kv)},
+		{"secure_hex", 1, false, secureHex},
+		{"secure_compare", 2, true, secureCompare},
+		{"sha256", 1, true, sha256Hex},
+		{"sha256_base64", 1, true, sha256Base64},
+		{"sha512", 1, true, sha512Hex},
+		{"sha512_base64", 1, true, sha512Base64},
+		{"hmac_sha256", 2, true, hmacSHA256Hex},
+		{"hmac_sha256_base64", 2, true, hmacSHA256Base64},
+		{"hmac_sha512", 2, true, hmacSHA512Hex},
+		{"hmac_sha512_base64", 2, true, hmacSHA512Base64},
+		{"argon2id_hash", 1, false, argon2idHash},
+		{"argon2id_verify", 2, true, argon2idVerify},
+		{"encrypt", -1, false, encrypt(crypto)}, // can take 1 or 2 arguments
+		{"decrypt", -1, true, decrypt(crypto)},  // can take 1 or 2 arguments
+		{"ed25519_keygen", 0, false, ed25519Keygen},
+		{"ed25519_sign", 2, true, ed25519SignB64},
+		{"ed25519_sign_hex", 2, true, ed25519SignHex},
+		{"ed25519_verify", 3, true, ed25519Verify},
+		{"jwt_sign", -1, false, jwtSign(jwt)},     // can take 1 or 2 arguments
+		{"jwt_verify", -1, false, jwtVerify(jwt)}, // can take 1 or 2 arguments
 		{"build_query", 1, true, buildQuery},
 		{"parse_query", 1, true, parseQuery},
-		{"http_get", -1, false, httpGet},          // can take 1 or 2 arguments
-		{"http_post", -1, false, httpPost},        // can take 1-3 arguments
-		{"http_put", -1, false, httpPut},          // can take 1-3 arguments
-		{"http_patch", -1, false, httpPatch},      // can take 1-3 arguments
-		{"http_delete", -1, false, httpDelete},    // can take 1 or 2 arguments
-		{"time_now", -1, false, TimeNow},          // can take 0 or 1 arguments
-		{"time_format", -1, true, TimeFormat},     // can take 2 or 3 arguments
-		{"time_add", -1, true, TimeAdd},           // can take 2 or 3 arguments
-		{"time_diff", -1, true, TimeDiff},         // can take 2 or 3 arguments
-		{"time_relative", -1, true, TimeRelative}, // can take 1 or 2 arguments
+		{"base64_encode", 1, true, base64Encode},
+		{"base64_decode", 1, true, base64Decode},
+		{"url_encode", 1, true, urlEncode},
+		{"url_decode", 1, true, urlDecode},
+		{"html_escape", 1, true, htmlEscape},
+		{"markdown_to_html", 1, true, markdownToHTML(md)},
+		{"uuid_v4", 0, false, uuidV4},
+		{"uuid_v7", 0, false, uuidV7},
+		{"ulid", 0, false, ulid},
+		{"nanoid", -1, false, nanoid}, // can take 0-2 arguments
+		{"regexp_match", 2, true, regexpMatch},
+		{"regexp_replace", 3, true, regexpReplace},
+		{"regexp_extract", -1, true, regexpExtract},     // can take 2 or 3 arguments
+		{"sprintf", -1, true, sprintf},                  // variadic - format and its arguments
+		{"truncate_words", -1, true, truncateWords},     // can take 2 or 3 arguments
+		{"http_get", -1, false, httpGet(client)},        // can take 1-3 arguments
+		{"http_post", -1, false, httpPost(client)},      // can take 1-4 arguments
+		{"http_put", -1, false, httpPut(client)},        // can take 1-4 arguments
+		{"http_patch", -1, false, httpPatch(client)},    // can take 1-4 arguments
+		{"http_delete", -1, false, httpDelete(client)},  // can take 1-3 arguments
+		{"time_now", -1, false, TimeNow},                // can take 0-2 arguments
+		{"time_format", -1, true, TimeFormat},           // can take 2-4 arguments
+		{"time_add", -1, true, TimeAdd},                 // can take 2-4 arguments
+		{"time_diff", -1, true, TimeDiff},               // can take 2 or 3 arguments
+		{"time_relative", -1, false, TimeRelative},      // can take 1 or 2 arguments
+		{"time_humanize", -1, true, TimeHumanize},       // can take 1 or 2 arguments
+		{"time_start_of", -1, true, TimeStartOf},        // can take 2-4 arguments
+		{"time_end_of", -1, true, TimeEndOf},            // can take 2-4 arguments
+		{"search_highlight", -1, true, searchHighlight}, // can take 2-4 arguments
+		{"search_snippet", -1, true, searchSnippet},     // can take 2 or 3 arguments
+		{"request_id", 0, false, requestID},
+		{"request_route", 0, false, requestRoute},
+		{"request_deadline", 0, false, requestDeadline},
+		{"request_remaining", 0, false, requestRemaining},
+		{"request_cancelled", 0, false, requestCancelled},
+	}
+}
+
+// Aggregate is a user defined aggregate function, which can also be used as a window function
+type Aggregate struct {
+	Name  string
+	NArgs int32
+	Make  func() sqlite.AggregateFunction
+}
+
+// Aggregates returns every aggregate function provided by wtfhttpd
+func Aggregates() []Aggregate {
+	return []Aggregate{
+		{"json_group_object_agg", 2, func() sqlite.AggregateFunction { return &jsonGroupObjectAgg{} }},
+		{"median", 1, func() sqlite.AggregateFunction { return &median{} }},
+		{"percentile", 2, func() sqlite.AggregateFunction { return &percentile{} }},
+		{"string_agg_distinct", -1, func() sqlite.AggregateFunction { return &stringAggDistinct{} }}, // can take 1 or 2 arguments
+		{"histogram", 2, func() sqlite.AggregateFunction { return &histogram{} }},
+	}
+}
+
+// TableFunctions returns every table function provided by wtfhttpd
+func TableFunctions(client *HTTPClient) []TableFunction {
+	return []TableFunction{
+		{"wtf_csv_rows", []string{"row", "data"}, []string{"text", "header", "delimiter"}, 1, true, csvRows},
+		{"wtf_regex_matches", []string{"match", "start", "groups"}, []string{"text", "pattern"}, 2, true, regexMatches},
+		{"wtf_split", []string{"value", "position"}, []string{"text", "sep"}, 2, true, split},
+		{"wtf_http_get_rows", []string{"key", "value", "type"}, []string{"url", "headers", "path"}, 1, false, httpGetRows(client)},
+		{"wtf_functions", []string{"name", "type", "nargs", "deterministic"}, nil, 0, true, wtfFunctions},
 	}
+}
 
-	for _, fn := range functions {
+// RegisterUdfs registers the functions, aggregates and table functions with SQLite,
+// and lists them in the wtf_functions table function
+func RegisterUdfs(kv *cache.KVCache, client *HTTPClient, crypto *Crypto, jwt *JWT, md goldmark.Markdown) {
+	for _, fn := range Functions(kv, client, crypto, jwt, md) {
 		err := sqlite.RegisterFunction(
-			fn.name,
+			fn.Name,
 			&sqlite.FunctionImpl{
-				NArgs:         fn.nArgs,
-				Deterministic: fn.deterministic,
-				Scalar:        fn.scalar,
+				NArgs:         fn.NArgs,
+				Deterministic: fn.Deterministic,
+				Scalar:        fn.Scalar,
 			},
 		)
 
 		if err != nil {
-			log.Fatalf("Error registering %s function: %v", fn.name, err)
+			log.Fatalf("Error registering %s function: %v", fn.Name, err)
 		}
+		catalog = append(catalog, FunctionInfo{fn.Name, "scalar", fn.NArgs, fn.Deterministic})
+	}
+
+	for _, agg := range Aggregates() {
+		err := sqlite.RegisterFunction(
+			agg.Name,
+			&sqlite.FunctionImpl{
+				NArgs:         agg.NArgs,
+				Deterministic: true,
+				MakeAggregate: func(sqlite.FunctionContext) (sqlite.AggregateFunction, error) {
+					return agg.Make(), nil
+				},
+			},
+		)
+
+		if err != nil {
+			log.Fatalf("Error registering %s function: %v", agg.Name, err)
+		}
+		catalog = append(catalog, FunctionInfo{agg.Name, "aggregate", agg.NArgs, true})
+	}
+
+	tableFunctions := TableFunctions(client)
+	if err := RegisterTableFunctions(tableFunctions); err != nil {
+		log.Fatal(err)
+	}
+	for _, fn := range tableFunctions {
+		catalog = append(catalog, FunctionInfo{fn.Name, "table", int32(len(fn.Args)), fn.Deterministic})
 	}
 }
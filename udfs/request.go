@@ -0,0 +1,336 @@
+package udfs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+// RequestInfo identifies the HTTP request a function is running for
+type RequestInfo struct {
+	ID     string
+	Route  string
+	Method string
+	Path   string
+}
+
+// requestScope is a request bound to the connection serving it
+type requestScope struct {
+	ctx  context.Context
+	info RequestInfo
+}
+
+// context returns the context of the request, or a background context outside of one
+func (s *requestScope) context() context.Context {
+	if s == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// requestConn is a connection opened by NewConnector, which the handler binds to the
+// request it takes the connection for. Statements run on it end with the request, and
+// the functions they call find the request through the connection calling them.
+type requestConn struct {
+	driver.Conn
+	state uintptr
+	scope atomic.Pointer[requestScope]
+}
+
+// conns are the open connections of NewConnector, by their SQLite thread state
+var conns sync.Map
+
+// newRequestConn wraps a connection of the SQLite driver
+func newRequestConn(conn driver.Conn) (*requestConn, error) {
+	state := threadState(conn)
+	if _, ok := reflect.TypeFor[sqlite.FunctionContext]().FieldByName("tls"); !ok || state == 0 {
+		return nil, fmt.Errorf("can't tell which connection functions are called on with %T", conn)
+	}
+
+	c := &requestConn{Conn: conn, state: state}
+	conns.Store(state, c)
+	return c, nil
+}
+
+// threadState returns the address of the SQLite thread state of a connection of the
+// driver, or of the connection a function is called on, or 0 if it has none. The driver
+// gives every connection its own, and passes it to the functions its statements call,
+// but doesn't export it.
+func threadState(v any) uintptr {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return 0
+	}
+
+	field := value.Elem().FieldByName("tls")
+	if !field.IsValid() || field.Kind() != reflect.Pointer {
+		return 0
+	}
+	return field.Pointer()
+}
+
+// requestOf returns the request bound to the connection a function is called on, or nil
+// outside of a request
+func requestOf(fc *sqlite.FunctionContext) *requestScope {
+	c, ok := conns.Load(threadState(fc))
+	if !ok {
+		return nil
+	}
+	return c.(*requestConn).scope.Load()
+}
+
+// requestFunctions are the functions that use the request they're called for
+var requestFunctions = map[string]bool{
+	"request_id": true, "request_route": true, "request_deadline": true,
+	"request_remaining": true, "request_cancelled": true,
+	"http_get": true, "http_post": true, "http_put": true, "http_patch": true, "http_delete": true,
+}
+
+// UsesRequest is whether the function uses the request it's called for
+func (f Function) UsesRequest() bool {
+	return requestFunctions[f.Name]
+}
+
+// BoundRequest is a request bound to the connection serving it
+type BoundRequest struct {
+	conn *requestConn
+	db   *sql.Conn
+}
+
+// BindRequest binds a connection to a request until it's unbound. Statements run on it are
+// interrupted once the request's context is done, unless they're run with a cancellable
+// context of their own, and the functions they call see the request.
+func BindRequest(conn *sql.Conn, ctx context.Context, info RequestInfo) (*BoundRequest, error) {
+	var c *requestConn
+	err := conn.Raw(func(dc any) error {
+		var ok bool
+		if c, ok = dc.(*requestConn); !ok {
+			return fmt.Errorf("connection %T wasn't opened by NewConnector", dc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.scope.Store(&requestScope{ctx: ctx, info: info})
+	return &BoundRequest{conn: c, db: conn}, nil
+}
+
+// Call calls a function outside of a statement, e.g. from a template. A function that uses
+// the request is called by a statement on the request's connection, so it finds the request
+// the same way it does when a query calls it. Without a request, the function is called
+// directly.
+func (req *BoundRequest) Call(fn Function, args []driver.Value) (driver.Value, error) {
+	if req == nil || !fn.UsesRequest() {
+		return fn.Scalar(nil, args)
+	}
+
+	scope := req.conn.scope.Load()
+	if scope == nil {
+		return fn.Scalar(nil, args)
+	}
+
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg
+	}
+	query := fmt.Sprintf("SELECT %s(%s)", fn.Name, strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", "))
+
+	var result any
+	if err := req.db.QueryRowContext(scope.ctx, query, values...).Scan(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Unbind unbinds the connection, so statements run on it afterwards, like the ones
+// cleaning up after a cancelled request, aren't interrupted
+func (req *BoundRequest) Unbind() {
+	req.conn.scope.Store(nil)
+}
+
+// statementContext returns the context to run a statement with. Statements that can't be
+// cancelled otherwise, e.g. the ones run by tx.Query, end with the bound request.
+func statementContext(ctx context.Context, scope *requestScope) context.Context {
+	if scope == nil || ctx.Done() != nil {
+		return ctx
+	}
+	return scope.ctx
+}
+
+func (c *requestConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *requestConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &requestStmt{Stmt: stmt, conn: c}, nil
+}
+
+func (c *requestConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *requestConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.Conn.(driver.ExecerContext).ExecContext(statementContext(ctx, c.scope.Load()), query, args)
+}
+
+func (c *requestConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(statementContext(ctx, c.scope.Load()), query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &requestRows{Rows: rows, conn: c}, nil
+}
+
+// ResetSession unbinds a connection going back to the pool, in case its request didn't
+func (c *requestConn) ResetSession(ctx context.Context) error {
+	c.scope.Store(nil)
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+// Close forgets the connection before closing it
+func (c *requestConn) Close() error {
+	conns.Delete(c.state)
+	return c.Conn.Close()
+}
+
+func (c *requestConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+// requestStmt is a prepared statement of a requestConn
+type requestStmt struct {
+	driver.Stmt
+	conn *requestConn
+}
+
+func (s *requestStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *requestStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *requestStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.Stmt.(driver.StmtExecContext).ExecContext(statementContext(ctx, s.conn.scope.Load()), args)
+}
+
+func (s *requestStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(statementContext(ctx, s.conn.scope.Load()), args)
+	if err != nil {
+		return nil, err
+	}
+	return &requestRows{Rows: rows, conn: s.conn}, nil
+}
+
+// namedValues numbers positional arguments like database/sql does
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+// requestRows are the rows of a statement run on a requestConn. The driver only
+// interrupts a statement while it finds the first row, so later rows stop once
+// the bound request is done.
+type requestRows struct {
+	driver.Rows
+	conn *requestConn
+}
+
+func (r *requestRows) Next(dest []driver.Value) error {
+	scope := r.conn.scope.Load()
+	if scope != nil && scope.ctx.Err() != nil {
+		return context.Cause(scope.ctx)
+	}
+	return r.Rows.Next(dest)
+}
+
+// requestContext returns the context of the request a function is called for, or a
+// background context for functions called outside of a request
+func requestContext(fc *sqlite.FunctionContext) context.Context {
+	return requestOf(fc).context()
+}
+
+// checkCancelled returns an error once the request's context is done, so long running
+// functions stop the query instead of working for a client that's gone
+func checkCancelled(ctx context.Context, name string) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: request cancelled: %v", name, context.Cause(ctx))
+}
+
+// requestField returns a function reading a field of the current request,
+// or NULL outside of a request
+func requestField(name string, field func(*requestScope) driver.Value) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(fc *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("%s takes no arguments, got %d", name, len(args))
+		}
+
+		scope := requestOf(fc)
+		if scope == nil {
+			return nil, nil
+		}
+		return field(scope), nil
+	}
+}
+
+// requestID returns the ID of the current request.
+// Usage: request_id()
+var requestID = requestField("request_id", func(scope *requestScope) driver.Value {
+	return scope.info.ID
+})
+
+// requestRoute returns the file serving the current request.
+// Usage: request_route()
+var requestRoute = requestField("request_route", func(scope *requestScope) driver.Value {
+	return scope.info.Route
+})
+
+// requestDeadline returns when the current request times out, or NULL if it has no timeout.
+// Usage: request_deadline()
+var requestDeadline = requestField("request_deadline", func(scope *requestScope) driver.Value {
+	deadline, ok := scope.ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	return deadline.UTC().Format("2006-01-02 15:04:05")
+})
+
+// requestRemaining returns the milliseconds left before the current request times out,
+// or NULL if it has no timeout.
+// Usage: request_remaining()
+var requestRemaining = requestField("request_remaining", func(scope *requestScope) driver.Value {
+	deadline, ok := scope.ctx.Deadline()
+	if !ok {
+		return nil
+	}
+	return max(0, time.Until(deadline).Milliseconds())
+})
+
+// requestCancelled returns 1 once the client has gone away or the request has timed out.
+// Usage: request_cancelled()
+var requestCancelled = requestField("request_cancelled", func(scope *requestScope) driver.Value {
+	if scope.ctx.Err() != nil {
+		return int64(1)
+	}
+	return int64(0)
+})
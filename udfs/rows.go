@@ -0,0 +1,166 @@
+package udfs
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// textArg reads a text argument of a table function. NULL reads as an empty string.
+func textArg(name string, value driver.Value) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	return "", fmt.Errorf("%s must be text, got %T", name, value)
+}
+
+// csvRows returns the records of CSV text. With a header, each record is a JSON
+// object keyed by the header's names, otherwise it's a JSON array.
+// Usage: SELECT row, data FROM wtf_csv_rows(text, [header], [delimiter])
+func csvRows(_ context.Context, args []driver.Value) ([][]driver.Value, error) {
+	text, err := textArg("text", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	header := true
+	if args[1] != nil {
+		n, ok := args[1].(int64)
+		if !ok {
+			return nil, fmt.Errorf("header must be 0 or 1, got %v", args[1])
+		}
+		header = n != 0
+	}
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	if args[2] != nil {
+		delimiter, err := textArg("delimiter", args[2])
+		if err != nil {
+			return nil, err
+		}
+		r, size := utf8.DecodeRuneInString(delimiter)
+		if size == 0 || size != len(delimiter) {
+			return nil, fmt.Errorf("delimiter must be a single character, got '%s'", delimiter)
+		}
+		reader.Comma = r
+	}
+
+	var names []string
+	var rows [][]driver.Value
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if header && names == nil {
+			names = record
+			continue
+		}
+
+		var data any = record
+		if header {
+			object := make(map[string]any, len(names))
+			for i, name := range names {
+				object[name] = nil
+				if i < len(record) {
+					object[name] = record[i]
+				}
+			}
+			// Fields past the header are named by their position
+			for i := len(names); i < len(record); i++ {
+				object[fmt.Sprintf("column%d", i+1)] = record[i]
+			}
+			data = object
+		}
+
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, []driver.Value{int64(len(rows) + 1), string(encoded)})
+	}
+
+	return rows, nil
+}
+
+// regexMatches returns every match of a regular expression in text, with the
+// 1-based character position it starts at and its capture groups as a JSON array.
+// Usage: SELECT match, start, groups FROM wtf_regex_matches(text, pattern)
+func regexMatches(_ context.Context, args []driver.Value) ([][]driver.Value, error) {
+	text, err := textArg("text", args[0])
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := textArg("pattern", args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	var rows [][]driver.Value
+	for _, match := range re.FindAllStringSubmatchIndex(text, -1) {
+		groups := make([]any, 0, len(match)/2-1)
+		for i := 2; i < len(match); i += 2 {
+			if match[i] < 0 {
+				groups = append(groups, nil)
+			} else {
+				groups = append(groups, text[match[i]:match[i+1]])
+			}
+		}
+
+		encoded, err := json.Marshal(groups)
+		if err != nil {
+			return nil, err
+		}
+
+		start := int64(utf8.RuneCountInString(text[:match[0]]) + 1)
+		rows = append(rows, []driver.Value{text[match[0]:match[1]], start, string(encoded)})
+	}
+
+	return rows, nil
+}
+
+// split returns the parts of text between each separator, along with their
+// 1-based position. An empty separator splits text into characters.
+// Usage: SELECT value, position FROM wtf_split(text, sep)
+func split(_ context.Context, args []driver.Value) ([][]driver.Value, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	text, err := textArg("text", args[0])
+	if err != nil {
+		return nil, err
+	}
+	sep, err := textArg("sep", args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(text, sep)
+	rows := make([][]driver.Value, len(parts))
+	for i, part := range parts {
+		rows[i] = []driver.Value{part, int64(i + 1)}
+	}
+	return rows, nil
+}
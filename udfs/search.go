@@ -0,0 +1,165 @@
+package udfs
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"modernc.org/sqlite"
+)
+
+// ftsOperators are the words of the FTS5 query syntax that aren't search terms
+var ftsOperators = map[string]bool{"AND": true, "OR": true, "NOT": true, "NEAR": true}
+
+// searchTermsRegex builds a regex matching the words of text that start with a term
+// of an FTS5 query, so stemmed and prefix matches are highlighted too
+func searchTermsRegex(query string) *regexp.Regexp {
+	var terms []string
+	for _, word := range strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ':'
+	}) {
+		// Column filters, e.g. title:hello
+		if i := strings.LastIndex(word, ":"); i >= 0 {
+			word = word[i+1:]
+		}
+		if word == "" || ftsOperators[word] {
+			continue
+		}
+		terms = append(terms, regexp.QuoteMeta(word))
+	}
+
+	if len(terms) == 0 {
+		return nil
+	}
+	return regexp.MustCompile(`(?i)\b(?:` + strings.Join(terms, "|") + `)\w*`)
+}
+
+// highlightText HTML escapes text and wraps the words matching the search terms in open and close
+func highlightText(text string, terms *regexp.Regexp, open, close string) string {
+	if terms == nil {
+		return html.EscapeString(text)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, match := range terms.FindAllStringIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:match[0]]))
+		b.WriteString(open)
+		b.WriteString(html.EscapeString(text[match[0]:match[1]]))
+		b.WriteString(close)
+		last = match[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+// searchTextArgs reads the text and query arguments shared by the search functions
+func searchTextArgs(name string, args []driver.Value) (string, string, error) {
+	if len(args) < 2 {
+		return "", "", fmt.Errorf("%s requires at least 2 arguments, got %d", name, len(args))
+	}
+
+	var text string
+	switch v := args[0].(type) {
+	case nil:
+	case string:
+		text = v
+	case []byte:
+		text = string(v)
+	default:
+		text = fmt.Sprint(v)
+	}
+
+	query, ok := args[1].(string)
+	if !ok && args[1] != nil {
+		return "", "", fmt.Errorf("%s query must be a string, got %T", name, args[1])
+	}
+
+	return text, query, nil
+}
+
+// searchHighlight marks the words of a text matching a full text search query.
+// The text is HTML escaped, so the result can be output as is.
+// Usage: search_highlight(text, query, [open], [close])
+func searchHighlight(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) > 4 {
+		return nil, fmt.Errorf("search_highlight supports 2 to 4 arguments, got %d", len(args))
+	}
+
+	text, query, err := searchTextArgs("search_highlight", args)
+	if err != nil {
+		return nil, err
+	}
+
+	open, close := "<mark>", "</mark>"
+	if len(args) > 2 {
+		if open, err = stringArg("search_highlight", args[2]); err != nil {
+			return nil, err
+		}
+	}
+	if len(args) > 3 {
+		if close, err = stringArg("search_highlight", args[3]); err != nil {
+			return nil, err
+		}
+	}
+
+	return highlightText(text, searchTermsRegex(query), open, close), nil
+}
+
+// searchSnippet returns the words of a text around the first match of a full text
+// search query, with the matches highlighted like search_highlight.
+// Usage: search_snippet(text, query, [words])
+func searchSnippet(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) > 3 {
+		return nil, fmt.Errorf("search_snippet supports 2 or 3 arguments, got %d", len(args))
+	}
+
+	text, query, err := searchTextArgs("search_snippet", args)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 32
+	if len(args) > 2 {
+		n, ok := args[2].(int64)
+		if !ok || n <= 0 {
+			return nil, fmt.Errorf("search_snippet word count must be a positive integer")
+		}
+		size = int(n)
+	}
+
+	terms := searchTermsRegex(query)
+	words := strings.Fields(text)
+
+	start := 0
+	if terms != nil {
+		for i, word := range words {
+			if terms.MatchString(word) {
+				start = max(0, i-size/4)
+				break
+			}
+		}
+	}
+	end := min(len(words), start+size)
+
+	snippet := highlightText(strings.Join(words[start:end], " "), terms, "<mark>", "</mark>")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(words) {
+		snippet += "…"
+	}
+	return snippet, nil
+}
+
+// stringArg reads an optional string argument
+func stringArg(name string, value driver.Value) (string, error) {
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s arguments must be strings, got %T", name, value)
+	}
+	return s, nil
+}
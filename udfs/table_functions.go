@@ -0,0 +1,253 @@
+package udfs
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"modernc.org/sqlite/vtab"
+)
+
+// TableFunction is a function returning rows, used in the FROM clause of a query,
+// e.g. SELECT value FROM wtf_split('a,b,c', ',')
+type TableFunction struct {
+	Name string
+	// Columns are the columns of the rows
+	Columns []string
+	// Args are the arguments, the first Required of which must be given
+	Args     []string
+	Required int
+	// Deterministic is whether the same arguments always return the same rows
+	Deterministic bool
+	// Rows returns the rows for the arguments. ctx is the context of the request the
+	// query runs for, or a background context outside of one.
+	Rows func(ctx context.Context, args []driver.Value) ([][]driver.Value, error)
+}
+
+// tableFunctionModule implements a table function as a virtual table, with
+// its arguments as hidden columns
+type tableFunctionModule struct {
+	fn TableFunction
+}
+
+func (m *tableFunctionModule) Create(ctx vtab.Context, args []string) (vtab.Table, error) {
+	return m.Connect(ctx, args)
+}
+
+// Connect declares the table. Its argument is the thread state of the connection it's
+// created on, so its cursors can find the request the connection is bound to.
+func (m *tableFunctionModule) Connect(ctx vtab.Context, args []string) (vtab.Table, error) {
+	columns := append([]string{}, m.fn.Columns...)
+	for _, arg := range m.fn.Args {
+		columns = append(columns, arg+" HIDDEN")
+	}
+
+	if err := ctx.Declare(fmt.Sprintf("CREATE TABLE x(%s)", strings.Join(columns, ", "))); err != nil {
+		return nil, err
+	}
+
+	table := &tableFunctionTable{fn: m.fn}
+	if len(args) > 3 {
+		state, err := strconv.ParseUint(args[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid connection %q for %s", args[3], m.fn.Name)
+		}
+		if c, ok := conns.Load(uintptr(state)); ok {
+			table.conn = c.(*requestConn)
+		}
+	}
+	return table, nil
+}
+
+// tableFunctionTable is the table of a table function on a connection
+type tableFunctionTable struct {
+	fn   TableFunction
+	conn *requestConn
+}
+
+// BestIndex passes the arguments of the function to Filter, in order. IdxNum is a
+// bitmask of the arguments that were given. Plans missing required arguments are
+// made too expensive to pick, and Filter reports them if they're the only option.
+func (t *tableFunctionTable) BestIndex(info *vtab.IndexInfo) error {
+	given := 0
+	next := 0
+	for i := range t.fn.Args {
+		column := len(t.fn.Columns) + i
+		for j, constraint := range info.Constraints {
+			if constraint.Column == column && constraint.Usable && constraint.Op == vtab.OpEQ {
+				info.Constraints[j].ArgIndex = next
+				info.Constraints[j].Omit = true
+				given |= 1 << i
+				next++
+				break
+			}
+		}
+	}
+
+	info.IdxNum = int64(given)
+	info.EstimatedCost = 1
+	if required := 1<<t.fn.Required - 1; given&required != required {
+		info.EstimatedCost = 1e12
+	}
+	return nil
+}
+
+func (t *tableFunctionTable) Open() (vtab.Cursor, error) {
+	return &tableFunctionCursor{fn: t.fn, conn: t.conn}, nil
+}
+
+func (t *tableFunctionTable) Disconnect() error { return nil }
+
+func (t *tableFunctionTable) Destroy() error { return nil }
+
+// tableFunctionCursor holds the rows of a call of a table function
+type tableFunctionCursor struct {
+	fn   TableFunction
+	conn *requestConn
+	args []driver.Value
+	rows [][]driver.Value
+	row  int
+}
+
+func (c *tableFunctionCursor) Filter(idxNum int, _ string, vals []vtab.Value) error {
+	c.args = make([]driver.Value, len(c.fn.Args))
+	next := 0
+	for i := range c.fn.Args {
+		if idxNum&(1<<i) != 0 && next < len(vals) {
+			c.args[i] = vals[next]
+			next++
+		}
+	}
+
+	if required := 1<<c.fn.Required - 1; idxNum&required != required {
+		return fmt.Errorf("%s requires the arguments %s", c.fn.Name, strings.Join(c.fn.Args[:c.fn.Required], ", "))
+	}
+
+	var scope *requestScope
+	if c.conn != nil {
+		scope = c.conn.scope.Load()
+	}
+
+	rows, err := c.fn.Rows(scope.context(), c.args)
+	if err != nil {
+		return fmt.Errorf("%s: %v", c.fn.Name, err)
+	}
+	c.rows = rows
+	c.row = 0
+	return nil
+}
+
+func (c *tableFunctionCursor) Next() error {
+	c.row++
+	return nil
+}
+
+func (c *tableFunctionCursor) Eof() bool {
+	return c.row >= len(c.rows)
+}
+
+// Column returns a column of the current row, or the argument of a hidden column
+func (c *tableFunctionCursor) Column(col int) (vtab.Value, error) {
+	if col < len(c.fn.Columns) {
+		return c.rows[c.row][col], nil
+	}
+	return c.args[col-len(c.fn.Columns)], nil
+}
+
+func (c *tableFunctionCursor) Rowid() (int64, error) {
+	return int64(c.row + 1), nil
+}
+
+func (c *tableFunctionCursor) Close() error {
+	c.rows = nil
+	return nil
+}
+
+// tableFunctionPrefix starts the name of every table function. Their tables hide the
+// tables of the database with the same name, so they take wtfhttpd's own prefix.
+const tableFunctionPrefix = "wtf_"
+
+// RegisterTableFunctions registers the table functions as virtual table modules.
+// Connections opened by NewConnector can use them.
+func RegisterTableFunctions(functions []TableFunction) error {
+	for _, fn := range functions {
+		if !strings.HasPrefix(fn.Name, tableFunctionPrefix) {
+			return fmt.Errorf("table function %s must start with %s", fn.Name, tableFunctionPrefix)
+		}
+		if err := vtab.RegisterModule(nil, fn.Name, &tableFunctionModule{fn: fn}); err != nil {
+			return fmt.Errorf("error registering %s table function: %v", fn.Name, err)
+		}
+	}
+	return nil
+}
+
+// connector opens connections to a SQLite database with the table functions ready to use
+type connector struct {
+	dsn       string
+	functions []TableFunction
+	driver    driver.Driver
+}
+
+// CheckTableFunctions returns an error if the database has a table or view named
+// like a table function, since queries would get the table function instead
+func CheckTableFunctions(db *sql.DB, functions []TableFunction) error {
+	for _, fn := range functions {
+		var name string
+		err := db.QueryRow("SELECT name FROM main.sqlite_schema WHERE type IN ('table', 'view') AND name = ? COLLATE NOCASE", fn.Name).Scan(&name)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error checking for tables named %s: %v", fn.Name, err)
+		}
+		return fmt.Errorf("the %s table function hides the %s table of the database, which needs renaming", fn.Name, name)
+	}
+	return nil
+}
+
+// NewConnector returns a connector for sql.OpenDB, whose connections have a virtual
+// table in the temp schema for every table function. SQLite only makes a module
+// eponymous, usable without a CREATE VIRTUAL TABLE, when its xCreate and xConnect
+// are the same function or xCreate is NULL, and the SQLite driver registers every
+// Go module with separate trampolines for the two that vtab.Module can't change.
+// So the tables are created on every connection instead, which also keeps them out
+// of the database file, and CheckTableFunctions finds the tables of the database they
+// would hide. The connections can be bound to a request with BindRequest.
+func NewConnector(dsn string, functions []TableFunction) driver.Connector {
+	// The driver registered as "sqlite" is the one the UDFs are registered with
+	db, _ := sql.Open("sqlite", "")
+	defer db.Close()
+
+	return &connector{dsn: dsn, functions: functions, driver: db.Driver()}
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := newRequestConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	execer := conn.(driver.ExecerContext)
+	for _, fn := range c.functions {
+		query := fmt.Sprintf("CREATE VIRTUAL TABLE temp.%s USING %s(%d)", fn.Name, fn.Name, rc.state)
+		if _, err := execer.ExecContext(ctx, query, nil); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("error creating %s table function: %v", fn.Name, err)
+		}
+	}
+
+	return rc, nil
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
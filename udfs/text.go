@@ -0,0 +1,219 @@
+package udfs
+
+import (
+	"container/list"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"modernc.org/sqlite"
+)
+
+// maxRegexps is how many compiled patterns are cached. Patterns are usually literals in
+// queries, but they can also come from columns or parameters, with no limit on how many.
+const maxRegexps = 256
+
+// regexpCache keeps the most recently used compiled patterns, since the regexp_*
+// functions are usually called on every row
+type regexpCache struct {
+	mu       sync.Mutex
+	order    *list.List // of *regexpEntry, most recently used first
+	patterns map[string]*list.Element
+}
+
+type regexpEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+var regexps = &regexpCache{order: list.New(), patterns: make(map[string]*list.Element)}
+
+func (c *regexpCache) get(pattern string) (*regexp.Regexp, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.patterns[pattern]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*regexpEntry).re, true
+}
+
+// add caches a compiled pattern, evicting the least recently used one if the cache is full
+func (c *regexpCache) add(pattern string, re *regexp.Regexp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.patterns[pattern]; ok {
+		return
+	}
+	c.patterns[pattern] = c.order.PushFront(&regexpEntry{pattern: pattern, re: re})
+
+	if c.order.Len() > maxRegexps {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.patterns, oldest.Value.(*regexpEntry).pattern)
+	}
+}
+
+// compileRegexp compiles a pattern, or returns it from the cache
+func compileRegexp(name, pattern string) (*regexp.Regexp, error) {
+	if re, ok := regexps.get(pattern); ok {
+		return re, nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s invalid pattern: %v", name, err)
+	}
+	regexps.add(pattern, re)
+	return re, nil
+}
+
+// regexpArgs reads the text and pattern arguments of the regexp_* functions
+func regexpArgs(name string, args []driver.Value) (string, *regexp.Regexp, error) {
+	text, err := textArg(name+" text", args[0])
+	if err != nil {
+		return "", nil, err
+	}
+	pattern, err := textArg(name+" pattern", args[1])
+	if err != nil {
+		return "", nil, err
+	}
+	re, err := compileRegexp(name, pattern)
+	return text, re, err
+}
+
+// regexpMatch reports whether text matches a regular expression.
+// Usage: regexp_match(text, pattern)
+func regexpMatch(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("regexp_match supports 2 arguments, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	text, re, err := regexpArgs("regexp_match", args)
+	if err != nil {
+		return nil, err
+	}
+	if re.MatchString(text) {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+// regexpReplace replaces every match of a regular expression, expanding $1 or ${name}
+// in the replacement to the text of a capture group.
+// Usage: regexp_replace(text, pattern, replacement)
+func regexpReplace(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) != 3 {
+		return nil, fmt.Errorf("regexp_replace supports 3 arguments, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	text, re, err := regexpArgs("regexp_replace", args)
+	if err != nil {
+		return nil, err
+	}
+	replacement, err := textArg("regexp_replace replacement", args[2])
+	if err != nil {
+		return nil, err
+	}
+	return re.ReplaceAllString(text, replacement), nil
+}
+
+// regexpExtract returns the first match of a regular expression, or of one of its
+// capture groups, by number or name. It returns NULL if nothing matches.
+// Usage: regexp_extract(text, pattern, [group])
+func regexpExtract(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, fmt.Errorf("regexp_extract supports 2 or 3 arguments, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	text, re, err := regexpArgs("regexp_extract", args)
+	if err != nil {
+		return nil, err
+	}
+
+	group := 0
+	if len(args) == 3 {
+		switch g := args[2].(type) {
+		case int64:
+			group = int(g)
+		case string:
+			group = re.SubexpIndex(g)
+		}
+		if group < 0 || group > re.NumSubexp() {
+			return nil, fmt.Errorf("regexp_extract pattern has no group %v", args[2])
+		}
+	}
+
+	match := re.FindStringSubmatchIndex(text)
+	if match == nil || match[2*group] < 0 {
+		return nil, nil
+	}
+	return text[match[2*group]:match[2*group+1]], nil
+}
+
+// sprintf formats its arguments with Go's fmt verbs, e.g. %v, %d, %05.2f, %q and %x,
+// where SQLite's own printf uses C's. Blobs are formatted as text.
+// Usage: sprintf(format, args...)
+func sprintf(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) < 1 {
+		return nil, fmt.Errorf("sprintf requires at least 1 argument, got %d", len(args))
+	}
+
+	format, err := textArg("sprintf format", args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]any, len(args)-1)
+	for i, arg := range args[1:] {
+		values[i] = textValue(arg)
+	}
+
+	return fmt.Sprintf(format, values...), nil
+}
+
+// truncateWords shortens text to a number of words, adding a suffix (default "…")
+// if any were cut. Usage: truncate_words(text, words, [suffix])
+func truncateWords(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) < 2 || len(args) > 3 {
+		return nil, fmt.Errorf("truncate_words supports 2 or 3 arguments, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+
+	text, err := textArg("truncate_words text", args[0])
+	if err != nil {
+		return nil, err
+	}
+	words, ok := args[1].(int64)
+	if !ok || words < 0 {
+		return nil, fmt.Errorf("truncate_words words must be a positive integer, got %v", args[1])
+	}
+	suffix := "…"
+	if len(args) == 3 {
+		if suffix, err = textArg("truncate_words suffix", args[2]); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := strings.Fields(text)
+	if int64(len(fields)) <= words {
+		return text, nil
+	}
+	return strings.Join(fields[:words], " ") + suffix, nil
+}
@@ -0,0 +1,105 @@
+package udfs
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"testing"
+)
+
+func TestRegexpExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		args []driver.Value
+		want driver.Value
+	}{
+		{"whole match", []driver.Value{"order 1234 shipped", `\d+`}, "1234"},
+		{"numbered group", []driver.Value{"2024-05-17", `(\d+)-(\d+)-(\d+)`, int64(2)}, "05"},
+		{"group zero", []driver.Value{"2024-05-17", `(\d+)-(\d+)`, int64(0)}, "2024-05"},
+		{"named group", []driver.Value{"user=alice id=7", `user=(?P<name>\w+) id=(?P<id>\d+)`, "name"}, "alice"},
+		{"second named group", []driver.Value{"user=alice id=7", `user=(?P<name>\w+) id=(?P<id>\d+)`, "id"}, "7"},
+		{"no match", []driver.Value{"no digits", `\d+`}, nil},
+		{"unmatched group", []driver.Value{"ab", `a(x)?b`, int64(1)}, nil},
+		{"null text", []driver.Value{nil, `\d+`}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := regexpExtract(nil, tt.args)
+			if err != nil {
+				t.Fatalf("regexp_extract error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("regexp_extract(%v) = %#v, want %#v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegexpExtractErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []driver.Value
+	}{
+		{"missing numbered group", []driver.Value{"abc", `(a)`, int64(2)}},
+		{"negative group", []driver.Value{"abc", `(a)`, int64(-1)}},
+		{"missing named group", []driver.Value{"abc", `(?P<x>a)`, "y"}},
+		{"invalid pattern", []driver.Value{"abc", `(`}},
+	}
+
+	for _, tt := range tests {
+		if _, err := regexpExtract(nil, tt.args); err == nil {
+			t.Errorf("regexp_extract with %s didn't fail", tt.name)
+		}
+	}
+}
+
+func TestRegexpCacheIsBounded(t *testing.T) {
+	for i := 0; i < maxRegexps*2; i++ {
+		if _, err := compileRegexp("test", fmt.Sprintf("pattern%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(regexps.patterns); n > maxRegexps {
+		t.Errorf("regexp cache has %d patterns, want at most %d", n, maxRegexps)
+	}
+	if _, ok := regexps.get(fmt.Sprintf("pattern%d", maxRegexps*2-1)); !ok {
+		t.Error("regexp cache evicted the most recent pattern")
+	}
+	if _, ok := regexps.get("pattern0"); ok {
+		t.Error("regexp cache kept the oldest pattern")
+	}
+}
+
+func TestTruncateWords(t *testing.T) {
+	tests := []struct {
+		name string
+		args []driver.Value
+		want driver.Value
+	}{
+		{"shorter", []driver.Value{"one two", int64(5)}, "one two"},
+		{"exact", []driver.Value{"one two three", int64(3)}, "one two three"},
+		{"truncated", []driver.Value{"one two three four", int64(2)}, "one two…"},
+		{"custom suffix", []driver.Value{"one two three", int64(1), "..."}, "one..."},
+		{"empty suffix", []driver.Value{"one two three", int64(2), ""}, "one two"},
+		{"collapses whitespace", []driver.Value{"one  \n two\tthree", int64(2)}, "one two…"},
+		{"zero words", []driver.Value{"one two", int64(0)}, "…"},
+		{"null", []driver.Value{nil, int64(2)}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := truncateWords(nil, tt.args)
+			if err != nil {
+				t.Fatalf("truncate_words error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("truncate_words(%v) = %#v, want %#v", tt.args, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := truncateWords(nil, []driver.Value{"one", int64(-1)}); err == nil {
+		t.Error("truncate_words with negative words didn't fail")
+	}
+}
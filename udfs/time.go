@@ -3,34 +3,254 @@ package udfs
 import (
 	"database/sql/driver"
 	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"modernc.org/sqlite"
 )
 
-// TimeNow returns the current time in the specified format or "2006-01-02 15:04:05" if no format is provided
-func TimeNow(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
-	format := "2006-01-02 15:04:05"
-	if len(args) > 0 {
-		if fmtx, ok := args[0].(string); ok {
-			format = fmtx
-		} else {
-			return nil, fmt.Errorf("time_now format argument must be a string, got %T", args[0])
-		}
+// defaultLayout is the format of times given without one, which is the format of SQLite's datetime()
+const defaultLayout = "2006-01-02 15:04:05"
+
+// defaultLocation is the timezone the time_* functions show times and count calendar
+// units in, unless they're given one. It's set from the timezone config with SetTimezone.
+var defaultLocation = time.UTC
+
+// SetTimezone sets the default timezone of the time_* functions, e.g. "Europe/Berlin".
+// "Local" is the timezone of the server.
+func SetTimezone(name string) error {
+	if name == "" {
+		name = "UTC"
 	}
+	loc, err := loadLocation(name)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %s: %v", name, err)
+	}
+	defaultLocation = loc
+	return nil
+}
 
-	return time.Now().Format(format), nil
+// locations caches the timezones that have been loaded, since time.LoadLocation reads
+// the timezone database every time. Only names that exist are cached, so it's bounded.
+var locations sync.Map
+
+// loadLocation loads a timezone by its IANA name, or returns it from the cache
+func loadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
 }
 
-// TimeFormat formats a time string from one format to another
-func TimeFormat(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
-	if len(args) < 2 || len(args) > 3 {
-		return nil, fmt.Errorf("time_format requires 2 or 3 arguments, got %d", len(args))
+// autoLayouts are the layouts tried when a time is given without its format,
+// ISO 8601 and RFC 3339 first, then SQLite's date and time formats
+var autoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05Z07:00",
+	defaultLayout,
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+// namedFormats are formats that can be given by name
+var namedFormats = map[string]string{
+	"rfc3339":  time.RFC3339,
+	"iso8601":  time.RFC3339,
+	"rfc1123":  time.RFC1123,
+	"datetime": defaultLayout,
+	"date":     "2006-01-02",
+	"time":     "15:04:05",
+}
+
+// timeOptions reads the optional format and timezone arguments of a time_* function,
+// which always come in that order. Either can be NULL or empty to leave it out, so the
+// format defaults to "" and the timezone to the configured one.
+func timeOptions(name string, args []driver.Value) (string, *time.Location, error) {
+	format, err := optionalText(name+" format", args, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	zone, err := optionalText(name+" timezone", args, 1)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if zone == "" {
+		return format, defaultLocation, nil
+	}
+	loc, err := loadLocation(zone)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: unknown timezone %s", name, zone)
+	}
+	return format, loc, nil
+}
+
+// optionalText returns an optional text argument, or "" if it's missing or NULL
+func optionalText(name string, args []driver.Value, i int) (string, error) {
+	if i >= len(args) || args[i] == nil {
+		return "", nil
+	}
+	s, ok := args[i].(string)
+	if !ok {
+		return "", fmt.Errorf("%s must be a string, got %T", name, args[i])
 	}
+	return s, nil
+}
 
-	timeStr, ok := args[0].(string)
+// parseTime parses a time in a format, or in one of the autoLayouts if the format is
+// empty, or from a Unix timestamp. Times without an offset are UTC, which is how SQLite's
+// datetime() and CURRENT_TIMESTAMP write them. It returns the layout the time was in,
+// so results can be formatted the same way.
+func parseTime(value driver.Value, format string) (time.Time, string, error) {
+	switch v := value.(type) {
+	case int64:
+		return time.Unix(v, 0).UTC(), defaultLayout, nil
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)).UTC(), defaultLayout, nil
+	case []byte:
+		value = string(v)
+	}
+
+	s, ok := value.(string)
 	if !ok {
-		return nil, fmt.Errorf("time_format first argument must be a string, got %T", args[0])
+		return time.Time{}, "", fmt.Errorf("time must be a string or a Unix timestamp, got %T", value)
+	}
+
+	if format != "" {
+		layout, err := goLayout(format)
+		if err != nil {
+			return time.Time{}, "", err
+		}
+		t, err := time.Parse(layout, s)
+		return t, layout, err
+	}
+
+	s = strings.TrimSpace(s)
+	for _, layout := range autoLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, layout, nil
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0).UTC(), defaultLayout, nil
+	}
+	return time.Time{}, "", fmt.Errorf("can't recognise the time '%s', give its format", s)
+}
+
+// goLayout returns the Go layout of a format, which is a name like "rfc3339", a
+// strftime format like "%Y-%m-%d", or a Go layout like "2006-01-02"
+func goLayout(format string) (string, error) {
+	if layout, ok := namedFormats[strings.ToLower(format)]; ok {
+		return layout, nil
+	}
+	if !strings.Contains(format, "%") {
+		return format, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		layout, ok := strftimeLayouts[format[i]]
+		if !ok {
+			return "", fmt.Errorf("%%%c can't be used to parse times", format[i])
+		}
+		b.WriteString(layout)
+	}
+	return b.String(), nil
+}
+
+// strftimeLayouts are the Go layouts of the strftime conversions that have one
+var strftimeLayouts = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'e': "_2", 'H': "15", 'I': "03",
+	'M': "04", 'S': "05", 'p': "PM", 'b': "Jan", 'h': "Jan", 'B': "January",
+	'a': "Mon", 'A': "Monday", 'j': "002", 'Z': "MST", 'z': "-0700",
+	'F': "2006-01-02", 'T': "15:04:05", 'D': "01/02/06", 'R': "15:04", 'f': "05.000", '%': "%",
+}
+
+// formatTime formats a time with a format, like goLayout takes. strftime formats
+// also have %s (Unix time), %u and %w (day of the week), and %V (ISO week).
+func formatTime(t time.Time, format string) string {
+	if format == "" {
+		format = defaultLayout
+	}
+	if layout, ok := namedFormats[strings.ToLower(format)]; ok {
+		return t.Format(layout)
+	}
+	if !strings.Contains(format, "%") {
+		return t.Format(format)
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch c := format[i]; c {
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'u':
+			b.WriteString(strconv.Itoa((int(t.Weekday())+6)%7 + 1))
+		case 'w':
+			b.WriteString(strconv.Itoa(int(t.Weekday())))
+		case 'V':
+			_, week := t.ISOWeek()
+			fmt.Fprintf(&b, "%02d", week)
+		default:
+			if layout, ok := strftimeLayouts[c]; ok && c != '%' {
+				b.WriteString(t.Format(layout))
+			} else {
+				b.WriteByte('%')
+				b.WriteByte(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// TimeNow returns the current time in a format (default "2006-01-02 15:04:05"), in
+// a timezone (default: the configured timezone). Usage: time_now([format], [timezone])
+func TimeNow(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) > 2 {
+		return nil, fmt.Errorf("time_now supports up to 2 arguments, got %d", len(args))
+	}
+
+	format, loc, err := timeOptions("time_now", args)
+	if err != nil {
+		return nil, err
+	}
+	return formatTime(time.Now().In(loc), format), nil
+}
+
+// TimeFormat formats a time in another format, in a timezone (default: the configured
+// timezone). The source format is detected if it isn't given.
+// Usage: time_format(time, target_format, [source_format], [timezone])
+func TimeFormat(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) < 2 || len(args) > 4 {
+		return nil, fmt.Errorf("time_format requires 2 to 4 arguments, got %d", len(args))
 	}
 
 	targetFormat, ok := args[1].(string)
@@ -38,33 +258,55 @@ func TimeFormat(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, e
 		return nil, fmt.Errorf("time_format second argument must be a string, got %T", args[1])
 	}
 
-	// Default source format is RFC3339
-	sourceFormat := "2006-01-02 15:04:05"
-	if len(args) == 3 {
-		if fmtx, ok := args[2].(string); ok {
-			sourceFormat = fmtx
-		} else {
-			return nil, fmt.Errorf("time_format third argument must be a string, got %T", args[2])
-		}
+	sourceFormat, loc, err := timeOptions("time_format", args[2:])
+	if err != nil {
+		return nil, err
 	}
 
-	t, err := time.Parse(sourceFormat, timeStr)
+	t, _, err := parseTime(args[0], sourceFormat)
 	if err != nil {
 		return nil, fmt.Errorf("time_format parse error: %v", err)
 	}
 
-	return t.Format(targetFormat), nil
+	return formatTime(t.In(loc), targetFormat), nil
 }
 
-// TimeAdd adds a duration to a time string
-func TimeAdd(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
-	if len(args) < 2 || len(args) > 3 {
-		return nil, fmt.Errorf("time_add requires 2 or 3 arguments, got %d", len(args))
+// durationRegex matches the calendar units of a duration, which Go durations don't have
+var durationRegex = regexp.MustCompile(`^([+-]?)(?:(\d+)y)?(?:(\d+)mo)?(?:(\d+)w)?(?:(\d+)d)?(.*)$`)
+
+// parseDuration parses a Go duration like "1h30m", which can start with years (y),
+// months (mo), weeks (w) and days (d), e.g. "-1y2mo3d12h". Calendar units are
+// added with AddDate, so a month after January 31st is March 3rd or 2nd.
+func parseDuration(s string) (years, months, days int, d time.Duration, err error) {
+	m := durationRegex.FindStringSubmatch(strings.ReplaceAll(s, " ", ""))
+	if m == nil || m[0] == "" || m[0] == "+" || m[0] == "-" {
+		return 0, 0, 0, 0, fmt.Errorf("invalid duration '%s'", s)
 	}
 
-	timeStr, ok := args[0].(string)
-	if !ok {
-		return nil, fmt.Errorf("time_add first argument must be a string, got %T", args[0])
+	n := func(s string) int {
+		v, _ := strconv.Atoi(s)
+		return v
+	}
+	years, months, days = n(m[2]), n(m[3]), 7*n(m[4])+n(m[5])
+	if m[6] != "" {
+		if d, err = time.ParseDuration(m[6]); err != nil {
+			return 0, 0, 0, 0, err
+		}
+	}
+
+	if m[1] == "-" {
+		years, months, days, d = -years, -months, -days, -d
+	}
+	return years, months, days, d, nil
+}
+
+// TimeAdd adds a duration to a time, in the time's format or the format given. Days,
+// months and years are counted in the timezone, so adding a day across a daylight
+// saving change keeps the time of day there. The result is in the time's own timezone.
+// Usage: time_add(time, duration, [format], [timezone])
+func TimeAdd(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) < 2 || len(args) > 4 {
+		return nil, fmt.Errorf("time_add requires 2 to 4 arguments, got %d", len(args))
 	}
 
 	durationStr, ok := args[1].(string)
@@ -72,61 +314,42 @@ func TimeAdd(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, erro
 		return nil, fmt.Errorf("time_add second argument must be a string, got %T", args[1])
 	}
 
-	// Default format is RFC3339
-	format := "2006-01-02 15:04:05"
-	if len(args) == 3 {
-		if fmtx, ok := args[2].(string); ok {
-			format = fmtx
-		} else {
-			return nil, fmt.Errorf("time_add third argument must be a string, got %T", args[2])
-		}
+	format, loc, err := timeOptions("time_add", args[2:])
+	if err != nil {
+		return nil, err
 	}
 
-	t, err := time.Parse(format, timeStr)
+	t, layout, err := parseTime(args[0], format)
 	if err != nil {
 		return nil, fmt.Errorf("time_add parse error: %v", err)
 	}
 
-	duration, err := time.ParseDuration(durationStr)
+	years, months, days, duration, err := parseDuration(durationStr)
 	if err != nil {
 		return nil, fmt.Errorf("time_add duration parse error: %v", err)
 	}
 
-	return t.Add(duration).Format(format), nil
+	return t.In(loc).AddDate(years, months, days).Add(duration).In(t.Location()).Format(layout), nil
 }
 
-// TimeDiff returns the difference between two time strings as a duration
+// TimeDiff returns the difference between two times as a duration, e.g. "36h0m0s".
+// Usage: time_diff(time1, time2, [format])
 func TimeDiff(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
 	if len(args) < 2 || len(args) > 3 {
 		return nil, fmt.Errorf("time_diff requires 2 or 3 arguments, got %d", len(args))
 	}
 
-	timeStr1, ok := args[0].(string)
-	if !ok {
-		return nil, fmt.Errorf("time_diff first argument must be a string, got %T", args[0])
-	}
-
-	timeStr2, ok := args[1].(string)
-	if !ok {
-		return nil, fmt.Errorf("time_diff second argument must be a string, got %T", args[1])
-	}
-
-	// Default format is RFC3339
-	format := "2006-01-02 15:04:05"
-	if len(args) == 3 {
-		if fmtx, ok := args[2].(string); ok {
-			format = fmtx
-		} else {
-			return nil, fmt.Errorf("time_diff third argument must be a string, got %T", args[2])
-		}
+	format, err := optionalText("time_diff format", args, 2)
+	if err != nil {
+		return nil, err
 	}
 
-	t1, err := time.Parse(format, timeStr1)
+	t1, _, err := parseTime(args[0], format)
 	if err != nil {
 		return nil, fmt.Errorf("time_diff parse error for first time: %v", err)
 	}
 
-	t2, err := time.Parse(format, timeStr2)
+	t2, _, err := parseTime(args[1], format)
 	if err != nil {
 		return nil, fmt.Errorf("time_diff parse error for second time: %v", err)
 	}
@@ -134,27 +357,178 @@ func TimeDiff(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, err
 	return t1.Sub(t2).String(), nil
 }
 
-// TimeRelative returns a human-readable relative time string
-func TimeRelative(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+// TimeHumanize spells out a duration, or a number of seconds, in its largest units,
+// e.g. "1 day 2 hours". Usage: time_humanize(duration, [units])
+func TimeHumanize(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
 	if len(args) < 1 || len(args) > 2 {
-		return nil, fmt.Errorf("time_relative requires 1 or 2 arguments, got %d", len(args))
+		return nil, fmt.Errorf("time_humanize requires 1 or 2 arguments, got %d", len(args))
 	}
 
-	timeStr, ok := args[0].(string)
-	if !ok {
-		return nil, fmt.Errorf("time_relative first argument must be a string, got %T", args[0])
+	var d time.Duration
+	switch v := args[0].(type) {
+	case int64:
+		d = time.Duration(v) * time.Second
+	case float64:
+		d = time.Duration(v * float64(time.Second))
+	case string:
+		years, months, days, rest, err := parseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("time_humanize duration parse error: %v", err)
+		}
+		d = rest + time.Duration(years*365+months*30+days)*24*time.Hour
+	case nil:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("time_humanize first argument must be a duration or a number of seconds, got %T", args[0])
 	}
 
-	format := "2006-01-02 15:04:05" // Default format for parsing time strings like "2025-10-20 06:10:44"
+	units := int64(2)
 	if len(args) == 2 {
-		if fmtx, ok := args[1].(string); ok {
-			format = fmtx
+		n, ok := args[1].(int64)
+		if !ok || n < 1 {
+			return nil, fmt.Errorf("time_humanize second argument must be a positive integer, got %v", args[1])
+		}
+		units = n
+	}
+
+	return humanizeDuration(d, int(units)), nil
+}
+
+// humanizeDuration spells out the largest units of a duration
+func humanizeDuration(d time.Duration, units int) string {
+	if d < 0 {
+		d = -d
+	}
+
+	steps := []struct {
+		name string
+		size time.Duration
+	}{
+		{"year", 365 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+		{"week", 7 * 24 * time.Hour},
+		{"day", 24 * time.Hour},
+		{"hour", time.Hour},
+		{"minute", time.Minute},
+		{"second", time.Second},
+	}
+
+	var parts []string
+	for _, step := range steps {
+		if len(parts) == units {
+			break
+		}
+		n := d / step.size
+		if n == 0 {
+			// Units are consecutive, so 1 year 3 days isn't shortened to 1 year 0 months
+			if len(parts) > 0 {
+				break
+			}
+			continue
+		}
+		d -= n * step.size
+		if n == 1 {
+			parts = append(parts, "1 "+step.name)
 		} else {
-			return nil, fmt.Errorf("time_relative second argument must be a string, got %T", args[1])
+			parts = append(parts, fmt.Sprintf("%d %ss", n, step.name))
+		}
+	}
+
+	if len(parts) == 0 {
+		return "0 seconds"
+	}
+	return strings.Join(parts, " ")
+}
+
+// startOf returns the start of the day, week (starting on Monday), month, quarter or year of a time
+func startOf(t time.Time, unit string) (time.Time, error) {
+	year, month, day := t.Date()
+	switch strings.ToLower(unit) {
+	case "day":
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location()), nil
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-offset, 0, 0, 0, 0, t.Location()), nil
+	case "month":
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location()), nil
+	case "quarter":
+		return time.Date(year, month-(month-1)%3, 1, 0, 0, 0, 0, t.Location()), nil
+	case "year":
+		return time.Date(year, 1, 1, 0, 0, 0, 0, t.Location()), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown unit '%s', expected day, week, month, quarter or year", unit)
+}
+
+// TimeStartOf and TimeEndOf return the first and last second of a day, week, month, quarter or year
+var (
+	TimeStartOf = calendar("time_start_of", false)
+	TimeEndOf   = calendar("time_end_of", true)
+)
+
+// calendar builds time_start_of and time_end_of, which return the first and last
+// second of the calendar unit a time is in, in the time's format or the format given.
+// Units start and end in the timezone, and the result is in the time's own timezone.
+// Usage: time_start_of(time, unit, [format], [timezone])
+func calendar(name string, end bool) func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error) {
+	return func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		if len(args) < 2 || len(args) > 4 {
+			return nil, fmt.Errorf("%s requires 2 to 4 arguments, got %d", name, len(args))
+		}
+
+		unit, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("%s second argument must be a string, got %T", name, args[1])
 		}
+
+		format, loc, err := timeOptions(name, args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		t, layout, err := parseTime(args[0], format)
+		if err != nil {
+			return nil, fmt.Errorf("%s parse error: %v", name, err)
+		}
+
+		start, err := startOf(t.In(loc), unit)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		if !end {
+			return start.In(t.Location()).Format(layout), nil
+		}
+
+		var next time.Time
+		switch strings.ToLower(unit) {
+		case "day":
+			next = start.AddDate(0, 0, 1)
+		case "week":
+			next = start.AddDate(0, 0, 7)
+		case "month":
+			next = start.AddDate(0, 1, 0)
+		case "quarter":
+			next = start.AddDate(0, 3, 0)
+		case "year":
+			next = start.AddDate(1, 0, 0)
+		}
+		return next.Add(-time.Second).In(t.Location()).Format(layout), nil
+	}
+}
+
+// TimeRelative returns a human-readable relative time string, like "5 minutes ago".
+// It depends on the current time, so it isn't deterministic.
+// Usage: time_relative(time, [format])
+func TimeRelative(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, fmt.Errorf("time_relative requires 1 or 2 arguments, got %d", len(args))
+	}
+
+	format, err := optionalText("time_relative format", args, 1)
+	if err != nil {
+		return nil, err
 	}
 
-	t, err := time.Parse(format, timeStr)
+	t, _, err := parseTime(args[0], format)
 	if err != nil {
 		return nil, fmt.Errorf("time_relative parse error: %v", err)
 	}
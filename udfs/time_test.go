@@ -0,0 +1,94 @@
+package udfs
+
+import (
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"modernc.org/sqlite"
+)
+
+func TestTimeFunctions(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(*sqlite.FunctionContext, []driver.Value) (driver.Value, error)
+		args []driver.Value
+		want driver.Value
+	}{
+		{"format reads naive times as UTC", TimeFormat, []driver.Value{"2024-05-16 12:00:00", "15:04"}, "12:00"},
+		{"format in a timezone", TimeFormat, []driver.Value{"2024-05-16 12:00:00", "15:04", nil, "Asia/Kolkata"}, "17:30"},
+		{"format in a timezone with digits", TimeFormat, []driver.Value{"2024-05-16 12:00:00", "15:04", "", "Etc/GMT+5"}, "07:00"},
+		{"format in an abbreviated timezone", TimeFormat, []driver.Value{"2024-01-16 12:00:00", "15:04", nil, "MST"}, "05:00"},
+		{"format keeps offsets", TimeFormat, []driver.Value{"2024-05-16T12:00:00+02:00", "15:04"}, "10:00"},
+		{"format with a source format", TimeFormat, []driver.Value{"16/05/2024", "date", "%d/%m/%Y", "UTC"}, "2024-05-16"},
+		{"add", TimeAdd, []driver.Value{"2024-05-16 12:00:00", "1d2h"}, "2024-05-17 14:00:00"},
+		{"add keeps the time of day across daylight saving", TimeAdd, []driver.Value{"2024-03-30 12:00:00", "1d", nil, "Europe/Berlin"}, "2024-03-31 11:00:00"},
+		{"add keeps offsets", TimeAdd, []driver.Value{"2024-05-16T12:00:00+02:00", "1h"}, "2024-05-16T13:00:00+02:00"},
+		{"start of day in a timezone", TimeStartOf, []driver.Value{"2024-05-16 02:00:00", "day", nil, "America/New_York"}, "2024-05-15 04:00:00"},
+		{"end of month", TimeEndOf, []driver.Value{"2024-02-10", "month"}, "2024-02-29"},
+		{"diff", TimeDiff, []driver.Value{"2024-05-16 12:00:00", "2024-05-16T12:00:00+02:00"}, "2h0m0s"},
+		{"unix timestamps are UTC", TimeFormat, []driver.Value{int64(0), "datetime"}, "1970-01-01 00:00:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.fn(nil, tt.args)
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeRelativeReadsNaiveTimesAsUTC(t *testing.T) {
+	loc, err := loadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultLocation = loc
+	defer func() { defaultLocation = time.UTC }()
+
+	// The way SQLite's CURRENT_TIMESTAMP stores the time
+	now := time.Now().UTC().Add(-5 * time.Minute).Format(defaultLayout)
+	got, err := TimeRelative(nil, []driver.Value{now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "5 minutes ago" {
+		t.Errorf("time_relative(%q) = %q, want \"5 minutes ago\"", now, got)
+	}
+}
+
+func TestTimeOptionsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []driver.Value
+	}{
+		{"unknown timezone", []driver.Value{"2024-05-16", "date", nil, "Mars/Olympus_Mons"}},
+		{"timezone in the format position", []driver.Value{"2024-05-16", "date", "Europe/Berlin"}},
+		{"non-text timezone", []driver.Value{"2024-05-16", "date", nil, int64(5)}},
+	}
+
+	for _, tt := range tests {
+		if _, err := TimeFormat(nil, tt.args); err == nil {
+			t.Errorf("time_format with %s didn't fail", tt.name)
+		}
+	}
+}
+
+func TestLoadLocationIsCached(t *testing.T) {
+	first, err := loadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("loadLocation loaded the same timezone twice")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/locales/de"
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/es"
+	"github.com/go-playground/locales/fr"
+	"github.com/go-playground/locales/it"
+	"github.com/go-playground/locales/nl"
+	"github.com/go-playground/locales/pt"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	de_translations "github.com/go-playground/validator/v10/translations/de"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	es_translations "github.com/go-playground/validator/v10/translations/es"
+	fr_translations "github.com/go-playground/validator/v10/translations/fr"
+	it_translations "github.com/go-playground/validator/v10/translations/it"
+	nl_translations "github.com/go-playground/validator/v10/translations/nl"
+	pt_translations "github.com/go-playground/validator/v10/translations/pt"
+)
+
+// identifierRegex matches the table and column names allowed in SQL-backed validation rules
+var identifierRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// sqlRuleMessages are the messages for the SQL-backed rules in every supported
+// locale, since the validator translations don't know them. They're registered
+// as sql_<rule>, as the validator has a translation for its own unique rule.
+var sqlRuleMessages = map[string]map[string]string{
+	"en": {"unique": "{0} has already been taken", "exists": "{0} does not exist"},
+	"de": {"unique": "{0} ist bereits vergeben", "exists": "{0} existiert nicht"},
+	"es": {"unique": "{0} ya está en uso", "exists": "{0} no existe"},
+	"fr": {"unique": "{0} est déjà utilisé", "exists": "{0} n'existe pas"},
+	"it": {"unique": "{0} è già in uso", "exists": "{0} non esiste"},
+	"nl": {"unique": "{0} is al in gebruik", "exists": "{0} bestaat niet"},
+	"pt": {"unique": "{0} já está em uso", "exists": "{0} não existe"},
+}
+
+// ValidationError holds a human-readable message for every field that failed validation
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	messages := make([]string, 0, len(fields))
+	for _, field := range fields {
+		messages = append(messages, e.Fields[field])
+	}
+	return "Validation error: " + strings.Join(messages, "; ")
+}
+
+// fieldValidation is a single @wtf-validate directive
+type fieldValidation struct {
+	field   string
+	rules   string
+	message string
+}
+
+// newValidator creates the validator along with translated error messages for the supported locales.
+// English is used as the fallback locale.
+func newValidator() (*validator.Validate, *ut.UniversalTranslator) {
+	vd := validator.New()
+	translator := ut.New(en.New(), en.New(), de.New(), es.New(), fr.New(), it.New(), nl.New(), pt.New())
+
+	registrations := []struct {
+		locale   string
+		register func(*validator.Validate, ut.Translator) error
+	}{
+		{"en", en_translations.RegisterDefaultTranslations},
+		{"de", de_translations.RegisterDefaultTranslations},
+		{"es", es_translations.RegisterDefaultTranslations},
+		{"fr", fr_translations.RegisterDefaultTranslations},
+		{"it", it_translations.RegisterDefaultTranslations},
+		{"nl", nl_translations.RegisterDefaultTranslations},
+		{"pt", pt_translations.RegisterDefaultTranslations},
+	}
+
+	for _, registration := range registrations {
+		trans, _ := translator.GetTranslator(registration.locale)
+		if err := registration.register(vd, trans); err != nil {
+			// Untranslated errors still work, they're just less friendly
+			fmt.Printf("Error registering %s validation messages: %v\n", registration.locale, err)
+		}
+
+		for rule, message := range sqlRuleMessages[registration.locale] {
+			if err := trans.Add("sql_"+rule, message, false); err != nil {
+				fmt.Printf("Error registering %s %s message: %v\n", registration.locale, rule, err)
+			}
+		}
+	}
+
+	return vd, translator
+}
+
+// translatorFor picks the validation message translator from the request's Accept-Language header
+func (app *App) translatorFor(r *http.Request) ut.Translator {
+	var locales []string
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		tag = strings.ReplaceAll(tag, "-", "_")
+		locales = append(locales, tag, strings.SplitN(tag, "_", 2)[0])
+	}
+
+	trans, _ := app.ut.FindTranslator(locales...)
+	return trans
+}
+
+// validateQuery checks the @wtf-validate directives of a query against the bound variables.
+// Fields starting with "$" are looked up in the request_json table, and the
+// unique and exists rules are checked against the database inside the request transaction.
+func validateQuery(app *App, tx *sql.Tx, trans ut.Translator, directives []Directive, varsMap map[string]any) error {
+	var validations []fieldValidation
+	for _, directive := range directives {
+		if directive.name == "validate" && len(directive.params) >= 2 {
+			validations = append(validations, fieldValidation{
+				field:   directive.params[0],
+				rules:   directive.params[1],
+				message: strings.Join(directive.params[2:], " "),
+			})
+		}
+	}
+
+	if len(validations) == 0 {
+		return nil
+	}
+
+	failures := make(map[string]string)
+	for _, validation := range validations {
+		if _, failed := failures[validation.field]; failed {
+			continue
+		}
+
+		value, err := validationValue(tx, validation.field, varsMap)
+		if err != nil {
+			return err
+		}
+
+		var rules, sqlRules []string
+		for _, rule := range strings.Split(validation.rules, ",") {
+			if strings.HasPrefix(rule, "unique=") || strings.HasPrefix(rule, "exists=") {
+				sqlRules = append(sqlRules, rule)
+			} else {
+				rules = append(rules, rule)
+			}
+		}
+
+		message := ""
+		if len(rules) > 0 {
+			err := app.vd.VarWithKey(validation.field, value, strings.Join(rules, ","))
+			var validationErrs validator.ValidationErrors
+			if errors.As(err, &validationErrs) && len(validationErrs) > 0 {
+				message = validationErrs[0].Translate(trans)
+			} else if err != nil {
+				return fmt.Errorf("Invalid validation rule for %s: %v", validation.field, err)
+			}
+		}
+
+		if message == "" && len(sqlRules) > 0 {
+			message, err = checkSqlRules(tx, trans, validation.field, value, sqlRules)
+			if err != nil {
+				return err
+			}
+		}
+
+		if message != "" {
+			if validation.message != "" {
+				message = validation.message
+			}
+			failures[validation.field] = message
+		}
+	}
+
+	if len(failures) > 0 {
+		return &ValidationError{Fields: failures}
+	}
+
+	return nil
+}
+
+// validationValue returns the value a validation applies to, either a bound
+// variable or a path in the request_json table
+func validationValue(tx *sql.Tx, field string, varsMap map[string]any) (any, error) {
+	if !strings.HasPrefix(field, "$") {
+		return varsMap[field], nil
+	}
+
+	var value any
+	err := tx.QueryRow("SELECT value FROM request_json WHERE path = ?", field).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error reading %s from request_json: %v", field, err)
+	}
+
+	if b, ok := value.([]byte); ok {
+		return string(b), nil
+	}
+	return value, nil
+}
+
+// checkSqlRules runs the unique=table.column and exists=table.column rules.
+// Empty values are skipped, so they should be combined with required where needed.
+func checkSqlRules(tx *sql.Tx, trans ut.Translator, field string, value any, rules []string) (string, error) {
+	if value == nil || value == "" {
+		return "", nil
+	}
+
+	for _, rule := range rules {
+		name, target, _ := strings.Cut(rule, "=")
+		table, column, ok := strings.Cut(target, ".")
+		if !ok || !identifierRegex.MatchString(table) || !identifierRegex.MatchString(column) {
+			return "", fmt.Errorf("Invalid validation rule for %s: %s must be in the form %s=table.column", field, name, name)
+		}
+
+		var found bool
+		query := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM "%s" WHERE "%s" = ?)`, table, column)
+		if err := tx.QueryRow(query, value).Scan(&found); err != nil {
+			return "", fmt.Errorf("Error checking %s rule for %s: %v", name, field, err)
+		}
+
+		if (name == "unique" && found) || (name == "exists" && !found) {
+			message, err := trans.T("sql_"+name, field)
+			if err != nil {
+				return "", fmt.Errorf("Error translating %s rule for %s: %v", name, field, err)
+			}
+			return message, nil
+		}
+	}
+
+	return "", nil
+}
+
+// writeQueryError sends the error from executing a route's queries.
+// Validation errors are sent as JSON with a message per field, and routes
+// that timed out get a 503.
+func writeQueryError(w http.ResponseWriter, r *http.Request, code int, err error) {
+	// Queries fail once the request is cancelled, whatever they were doing
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		if errors.Is(ctxErr, context.DeadlineExceeded) {
+			http.Error(w, "Request timed out", http.StatusServiceUnavailable)
+		} else {
+			log.Printf("Request for %s cancelled: %v", r.URL.Path, err)
+		}
+		return
+	}
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":  "Validation failed",
+		"fields": validationErr.Fields,
+	})
+}